@@ -0,0 +1,330 @@
+// Package chunk provides a memalpha.Conn wrapper which stores values larger than the
+// memcached item size limit as multiple items.
+//
+// A large value is split into chunks stored under "<key>:<token>:<n>", where token is a
+// random version token unique to each write, and the key itself holds a small manifest
+// marked by FlagChunked. Since every write has its own chunks, a failed Add, Replace or
+// CompareAndSwap leaves the current value intact. Every chunk also starts with the token,
+// so chunks evicted by the server or tampered with are detected and reported as a cache
+// miss, while a corrupt manifest is reported as ErrCorruptManifest. The chunks of a
+// replaced value are not deleted; they expire or are evicted by the server in due course.
+package chunk
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+// FlagChunked is the bit of the item flags reserved to mark a manifest. Values stored
+// through Conn must not use this bit themselves.
+const FlagChunked uint32 = 1 << 30
+
+// DefaultChunkSize leaves room for the item header below the default 1MB item size limit
+// of memcached.
+const DefaultChunkSize = 1000 * 1024
+
+const tokenSize = 8
+
+// maxChunks bounds the number of chunks a manifest may refer to, so that a corrupt
+// manifest cannot make Gets request an unreasonable number of keys.
+const maxChunks = 4096
+
+// maxChunkKeys bounds the keys of a get command fetching chunks, so that its command line
+// stays far below the line length limit of the server.
+const maxChunkKeys = 100
+
+var (
+	// ErrReservedFlag means that the caller tried to store flags overlapping FlagChunked.
+	ErrReservedFlag = errors.New("memcache: flags must not contain the chunked bit")
+
+	// ErrTooLarge means a value needs more chunks than a manifest may refer to.
+	ErrTooLarge = errors.New("memcache: value too large to be chunked")
+
+	// ErrCorruptManifest means an item marked as a manifest could not be decoded.
+	ErrCorruptManifest = errors.New("memcache: corrupt chunk manifest")
+)
+
+type manifest struct {
+	token  [tokenSize]byte
+	chunks int
+	size   int
+}
+
+// encode serializes a manifest as <token> <number of chunks> <total size>, where the
+// numbers are unsigned varints.
+func (m *manifest) encode() []byte {
+	buf := make([]byte, 0, tokenSize+2*binary.MaxVarintLen64)
+	buf = append(buf, m.token[:]...)
+	buf = binary.AppendUvarint(buf, uint64(m.chunks))
+	return binary.AppendUvarint(buf, uint64(m.size))
+}
+
+func decodeManifest(data []byte) (*manifest, error) {
+	if len(data) < tokenSize {
+		return nil, ErrCorruptManifest
+	}
+	m := &manifest{}
+	copy(m.token[:], data)
+	data = data[tokenSize:]
+
+	chunks, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, ErrCorruptManifest
+	}
+	size, n := binary.Uvarint(data[n:])
+	if n <= 0 || chunks == 0 || chunks > maxChunks || chunks > size {
+		return nil, ErrCorruptManifest
+	}
+	m.chunks, m.size = int(chunks), int(size)
+	return m, nil
+}
+
+func chunkKey(key string, token [tokenSize]byte, i int) string {
+	return key + ":" + hex.EncodeToString(token[:]) + ":" + strconv.Itoa(i)
+}
+
+// Conn wraps a memalpha.Conn. Set, Add, Replace and CompareAndSwap split values larger
+// than the chunk size, and Get and Gets reassemble them.
+//
+// Append and Prepend are passed through untouched. Do not use them on keys whose value
+// may have been chunked.
+type Conn struct {
+	memalpha.Conn
+	chunkSize int
+}
+
+// NewConn returns a Conn splitting values larger than chunkSize bytes.
+func NewConn(c memalpha.Conn, chunkSize int) *Conn {
+	return &Conn{Conn: c, chunkSize: chunkSize}
+}
+
+// store stores value through storeFunc, writing chunks first if necessary.
+func (c *Conn) store(key string, value []byte, flags uint32, exptime int, storeFunc func(value []byte, flags uint32) error) error {
+	if flags&FlagChunked != 0 {
+		return ErrReservedFlag
+	}
+	if len(value) <= c.chunkSize {
+		return storeFunc(value, flags)
+	}
+
+	m := &manifest{
+		chunks: (len(value) + c.chunkSize - 1) / c.chunkSize,
+		size:   len(value),
+	}
+	if m.chunks > maxChunks {
+		return ErrTooLarge
+	}
+	if _, err := io.ReadFull(rand.Reader, m.token[:]); err != nil {
+		return err
+	}
+	if !memalpha.LegalKey(chunkKey(key, m.token, m.chunks-1)) {
+		// Reject the key before anything is written.
+		return memalpha.ErrMalformedKey
+	}
+
+	buf := make([]byte, tokenSize+c.chunkSize)
+	copy(buf, m.token[:])
+	for i := 0; i < m.chunks; i++ {
+		end := (i + 1) * c.chunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		n := copy(buf[tokenSize:], value[i*c.chunkSize:end])
+		if err := c.Conn.Set(chunkKey(key, m.token, i), buf[:tokenSize+n], 0, exptime, false); err != nil {
+			c.deleteChunks(key, m, i)
+			return err
+		}
+	}
+
+	// The manifest is written last, so readers never see it before its chunks.
+	if err := storeFunc(m.encode(), flags|FlagChunked); err != nil {
+		c.deleteChunks(key, m, m.chunks)
+		return err
+	}
+	return nil
+}
+
+// deleteChunks deletes the first n chunks of a manifest which was not stored. Failures
+// are ignored, as the chunks expire anyway.
+func (c *Conn) deleteChunks(key string, m *manifest, n int) {
+	for i := 0; i < n; i++ {
+		_ = c.Conn.Delete(chunkKey(key, m.token, i), true)
+	}
+}
+
+// Set means "store this data".
+func (c *Conn) Set(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	return c.store(key, value, flags, exptime, func(value []byte, flags uint32) error {
+		return c.Conn.Set(key, value, flags, exptime, noreply)
+	})
+}
+
+// Add means "store this data, but only if the server *doesn't* already hold data for this
+// key".
+func (c *Conn) Add(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	return c.store(key, value, flags, exptime, func(value []byte, flags uint32) error {
+		return c.Conn.Add(key, value, flags, exptime, noreply)
+	})
+}
+
+// Replace means "store this data, but only if the server *does* already hold data for
+// this key".
+func (c *Conn) Replace(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	return c.store(key, value, flags, exptime, func(value []byte, flags uint32) error {
+		return c.Conn.Replace(key, value, flags, exptime, noreply)
+	})
+}
+
+// CompareAndSwap is a check and set operation which means "store this data but only if no
+// one else has updated since I last fetched it." The casid is the one of the manifest.
+func (c *Conn) CompareAndSwap(key string, value []byte, casid uint64, flags uint32, exptime int, noreply bool) error {
+	return c.store(key, value, flags, exptime, func(value []byte, flags uint32) error {
+		return c.Conn.CompareAndSwap(key, value, casid, flags, exptime, noreply)
+	})
+}
+
+// Get returns a value, flags and error. It returns memalpha.ErrCacheMiss if any chunk is
+// missing or stale, and ErrCorruptManifest if the manifest is corrupt.
+func (c *Conn) Get(key string) (value []byte, flags uint32, err error) {
+	m, err := c.Gets([]string{key})
+	if err != nil {
+		return nil, 0, err
+	}
+	response, ok := m[key]
+	if !ok {
+		return nil, 0, memalpha.ErrCacheMiss
+	}
+	return response.Value, response.Flags, nil
+}
+
+// Gets is an alternative get command for using with CAS. Chunked values with a missing or
+// stale chunk are left out of the result, and a corrupt manifest fails Gets with
+// ErrCorruptManifest, like Get. The chunks of all keys are fetched with additional
+// multi-key gets of a hundred keys at most.
+func (c *Conn) Gets(keys []string) (map[string]*memalpha.Response, error) {
+	m, err := c.Conn.Gets(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := make(map[string]*manifest)
+	var chunkKeys []string
+	for key, response := range m {
+		if response.Flags&FlagChunked == 0 {
+			continue
+		}
+		mf, err := decodeManifest(response.Value)
+		if err != nil {
+			return nil, err
+		}
+		manifests[key] = mf
+		for i := 0; i < mf.chunks; i++ {
+			chunkKeys = append(chunkKeys, chunkKey(key, mf.token, i))
+		}
+	}
+	if len(manifests) == 0 {
+		return m, nil
+	}
+
+	chunks := make(map[string]*memalpha.Response, len(chunkKeys))
+	for len(chunkKeys) > 0 {
+		n := len(chunkKeys)
+		if n > maxChunkKeys {
+			n = maxChunkKeys
+		}
+		batch, err := c.Conn.Gets(chunkKeys[:n])
+		if err != nil {
+			return nil, err
+		}
+		for k, response := range batch {
+			chunks[k] = response
+		}
+		chunkKeys = chunkKeys[n:]
+	}
+	for key, mf := range manifests {
+		value, ok := assemble(key, mf, chunks)
+		if !ok {
+			delete(m, key)
+			continue
+		}
+		m[key].Value = value
+		m[key].Flags &^= FlagChunked
+	}
+	return m, nil
+}
+
+func assemble(key string, m *manifest, chunks map[string]*memalpha.Response) ([]byte, bool) {
+	size := 0
+	for i := 0; i < m.chunks; i++ {
+		chunk, ok := chunks[chunkKey(key, m.token, i)]
+		if !ok || len(chunk.Value) < tokenSize || string(chunk.Value[:tokenSize]) != string(m.token[:]) {
+			return nil, false
+		}
+		size += len(chunk.Value) - tokenSize
+	}
+	if size != m.size {
+		return nil, false
+	}
+
+	value := make([]byte, 0, size)
+	for i := 0; i < m.chunks; i++ {
+		value = append(value, chunks[chunkKey(key, m.token, i)].Value[tokenSize:]...)
+	}
+	return value, true
+}
+
+// chunkKeys returns the chunk keys belonging to the manifest stored under key, if any. The
+// chunks of a corrupt manifest cannot be found, so it has none.
+func (c *Conn) chunkKeys(key string) ([]string, error) {
+	value, flags, err := c.Conn.Get(key)
+	if err != nil || flags&FlagChunked == 0 {
+		return nil, err
+	}
+	m, err := decodeManifest(value)
+	if err != nil {
+		return nil, nil
+	}
+	keys := make([]string, m.chunks)
+	for i := range keys {
+		keys[i] = chunkKey(key, m.token, i)
+	}
+	return keys, nil
+}
+
+// Delete deletes the item with the provided key along with its chunks.
+func (c *Conn) Delete(key string, noreply bool) error {
+	keys, err := c.chunkKeys(key)
+	if err != nil && err != memalpha.ErrCacheMiss {
+		return err
+	}
+	if err = c.Conn.Delete(key, noreply); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err = c.Conn.Delete(k, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Touch is used to update the expiration time of an existing item and its chunks without
+// fetching it.
+func (c *Conn) Touch(key string, exptime int32, noreply bool) error {
+	keys, err := c.chunkKeys(key)
+	if err != nil && err != memalpha.ErrCacheMiss {
+		return err
+	}
+	for _, k := range keys {
+		if err = c.Conn.Touch(k, exptime, true); err != nil {
+			return err
+		}
+	}
+	return c.Conn.Touch(key, exptime, noreply)
+}
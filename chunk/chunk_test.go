@@ -0,0 +1,172 @@
+package chunk
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+)
+
+func TestChunk(t *testing.T) {
+	backend := memdtest.NewFakeConn()
+	c := NewConn(backend, 10)
+	large := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	err := c.Set("small", []byte("val"), 42, 0, false)
+	assert.NoError(t, err)
+	raw, flags, err := backend.Get("small")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("val"), raw, "small values are stored as is")
+	assert.EqualValues(t, 42, flags)
+
+	err = c.Set("large", large, 42, 0, false)
+	assert.NoError(t, err)
+	mf := backendManifest(t, backend, "large")
+	_, flags, err = backend.Get("large")
+	assert.NoError(t, err)
+	assert.Equal(t, 42|FlagChunked, flags, "manifest is stored under the key")
+	assert.Equal(t, 4, mf.chunks)
+	for i := 0; i < mf.chunks; i++ {
+		key := chunkKey("large", mf.token, i)
+		assert.Regexp(t, `^large:[0-9a-f]{16}:\d$`, key)
+		_, _, err = backend.Get(key)
+		assert.NoError(t, err, "chunk %s", key)
+	}
+
+	value, flags, err := c.Get("large")
+	assert.NoError(t, err)
+	assert.Equal(t, large, value)
+	assert.EqualValues(t, 42, flags)
+
+	m, err := c.Gets([]string{"small", "large", "missing"})
+	assert.NoError(t, err)
+	assert.Len(t, m, 2)
+	assert.Equal(t, []byte("val"), m["small"].Value)
+	assert.Equal(t, large, m["large"].Value)
+	assert.EqualValues(t, 42, m["large"].Flags)
+
+	// CAS works against the manifest.
+	err = c.CompareAndSwap("large", bytes.ToUpper(large), m["large"].CasID, 0, 0, false)
+	assert.NoError(t, err)
+	value, _, err = c.Get("large")
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.ToUpper(large), value)
+	err = c.CompareAndSwap("large", large, m["large"].CasID, 0, 0, false)
+	assert.Equal(t, memalpha.ErrCasConflict, err)
+
+	mf = backendManifest(t, backend, "large")
+	err = c.Delete("large", false)
+	assert.NoError(t, err)
+	_, _, err = backend.Get(chunkKey("large", mf.token, 0))
+	assert.Equal(t, memalpha.ErrCacheMiss, err, "chunks are deleted")
+
+	err = c.Set("small", []byte("val"), FlagChunked, 0, false)
+	assert.Equal(t, ErrReservedFlag, err)
+}
+
+func TestMissingOrStaleChunk(t *testing.T) {
+	backend := memdtest.NewFakeConn()
+	c := NewConn(backend, 10)
+	large := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	// Evicted chunk
+	err := c.Set("large", large, 0, 0, false)
+	assert.NoError(t, err)
+	mf := backendManifest(t, backend, "large")
+	err = backend.Delete(chunkKey("large", mf.token, 1), false)
+	assert.NoError(t, err)
+	_, _, err = c.Get("large")
+	assert.Equal(t, memalpha.ErrCacheMiss, err)
+
+	// Chunk holding another token
+	err = c.Set("large", large, 0, 0, false)
+	assert.NoError(t, err)
+	mf = backendManifest(t, backend, "large")
+	err = backend.Set(chunkKey("large", mf.token, 2), []byte("XXXXXXXXklmnopqrst"), 0, 0, false)
+	assert.NoError(t, err)
+	_, _, err = c.Get("large")
+	assert.Equal(t, memalpha.ErrCacheMiss, err)
+
+	// Corrupt manifest
+	err = c.Set("good", large, 0, 0, false)
+	assert.NoError(t, err)
+	err = backend.Set("large", []byte("short"), FlagChunked, 0, false)
+	assert.NoError(t, err)
+	_, _, err = c.Get("large")
+	assert.Equal(t, ErrCorruptManifest, err)
+	_, err = c.Gets([]string{"large", "good"})
+	assert.Equal(t, ErrCorruptManifest, err)
+
+	// A corrupt manifest can still be touched and deleted.
+	assert.NoError(t, c.Touch("large", 10, false))
+	assert.NoError(t, c.Delete("large", false))
+	_, _, err = c.Get("large")
+	assert.Equal(t, memalpha.ErrCacheMiss, err)
+}
+
+// gatherConn records the number of keys of each Gets.
+type gatherConn struct {
+	memalpha.Conn
+	gets []int
+}
+
+func (c *gatherConn) Gets(keys []string) (map[string]*memalpha.Response, error) {
+	c.gets = append(c.gets, len(keys))
+	return c.Conn.Gets(keys)
+}
+
+func TestManyChunks(t *testing.T) {
+	backend := &gatherConn{Conn: memdtest.NewFakeConn()}
+	c := NewConn(backend, 10)
+	large := bytes.Repeat([]byte("0123456789"), 2*maxChunkKeys+1)
+
+	assert.NoError(t, c.Set("large", large, 0, 0, false))
+	value, _, err := c.Get("large")
+	assert.NoError(t, err)
+	assert.Equal(t, large, value)
+	assert.Equal(t, []int{1, maxChunkKeys, maxChunkKeys, 1}, backend.gets, "chunks are fetched in batches")
+}
+
+func TestFailedStore(t *testing.T) {
+	backend := memdtest.NewFakeConn()
+	c := NewConn(backend, 10)
+	large := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	other := bytes.ToUpper(large)
+
+	err := c.Set("large", large, 0, 0, false)
+	assert.NoError(t, err)
+	m, err := c.Gets([]string{"large"})
+	assert.NoError(t, err)
+	casid := m["large"].CasID
+	err = c.Set("large", large, 0, 0, false)
+	assert.NoError(t, err)
+
+	// Failed writes leave the current value intact.
+	err = c.Add("large", other, 0, 0, false)
+	assert.Equal(t, memalpha.ErrNotStored, err)
+	err = c.CompareAndSwap("large", other, casid, 0, 0, false)
+	assert.Equal(t, memalpha.ErrCasConflict, err)
+	err = c.Replace("missing", other, 0, 0, false)
+	assert.Equal(t, memalpha.ErrNotStored, err)
+
+	value, _, err := c.Get("large")
+	assert.NoError(t, err)
+	assert.Equal(t, large, value)
+
+	// Keys too long for their chunk keys are rejected before anything is written.
+	long := strings.Repeat("k", memalpha.MaxKeyLength-10)
+	err = c.Set(long, large, 0, 0, false)
+	assert.Equal(t, memalpha.ErrMalformedKey, err)
+	assert.NoError(t, c.Set(long, []byte("small"), 0, 0, false), "small values aren't chunked")
+}
+
+func backendManifest(t *testing.T, backend memalpha.Conn, key string) *manifest {
+	data, _, err := backend.Get(key)
+	assert.NoError(t, err)
+	mf, err := decodeManifest(data)
+	assert.NoError(t, err)
+	return mf
+}
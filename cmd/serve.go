@@ -0,0 +1,83 @@
+// Copyright © 2017 Tomohiro Takezawa
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/ttakezawa/memalpha/server"
+)
+
+var (
+	serveListen      string
+	servePort        int
+	serveMemory      int
+	serveMaxItemSize int
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run a memcached compatible server",
+	Long: `Run a memcached compatible server speaking the text protocol.
+
+Items are kept in memory and evicted in least recently used order once their
+total size exceeds the limit given by --memory. For example:
+
+  memalpha serve --port 11211 --memory 64`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		srv := server.New(server.NewCache(serveMemory * 1024 * 1024))
+		srv.MaxItemSize = serveMaxItemSize
+
+		l, err := net.Listen("tcp", net.JoinHostPort(serveListen, strconv.Itoa(servePort)))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("listening on %s\n", l.Addr())
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sig
+			_ = srv.Close()
+		}()
+
+		if err := srv.Serve(l); err != server.ErrServerClosed {
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(serveCmd)
+
+	serveCmd.Flags().StringVarP(&serveListen, "listen", "l", "127.0.0.1", "interface to listen on")
+	serveCmd.Flags().IntVarP(&servePort, "port", "p", 11211, "TCP port to listen on")
+	serveCmd.Flags().IntVarP(&serveMemory, "memory", "m", 64, "item memory in megabytes")
+	serveCmd.Flags().IntVarP(&serveMaxItemSize, "max-item-size", "I", server.DefaultMaxItemSize, "largest value in bytes")
+}
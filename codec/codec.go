@@ -0,0 +1,63 @@
+// Package codec provides typed access to memcached items on top of memalpha.Conn.
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+)
+
+// ErrCodecMismatch means an item was stored with a codec other than the one used to
+// read it.
+var ErrCodecMismatch = errors.New("memcache: item was encoded with a different codec")
+
+// Codec marshals values to and from item values. The ID is stored in the item flags, so
+// every Codec must have a distinct non-zero ID.
+type Codec interface {
+	ID() uint8
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// IDs of the built-in codecs. Custom codecs should use IDs of 128 and above.
+const (
+	IDJSON uint8 = 1
+	IDGob  uint8 = 2
+)
+
+var (
+	// JSON encodes values with encoding/json.
+	JSON Codec = jsonCodec{}
+
+	// Gob encodes values with encoding/gob.
+	Gob Codec = gobCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() uint8 { return IDJSON }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ID() uint8 { return IDGob }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,71 @@
+package codec
+
+import (
+	"time"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+// TypedCache stores values of type T through a Codec. The codec ID is kept in the low
+// byte of the item flags, and reading an item written by another codec fails with
+// ErrCodecMismatch. The other bits of the flags are ignored, so that wrappers of the Conn
+// may use them.
+type TypedCache[T any] struct {
+	conn  memalpha.Conn
+	codec Codec
+}
+
+// codecFlags is the part of the item flags holding the codec ID.
+const codecFlags = 0xff
+
+// NewTypedCache creates a TypedCache using codec over conn.
+func NewTypedCache[T any](conn memalpha.Conn, codec Codec) *TypedCache[T] {
+	return &TypedCache[T]{conn: conn, codec: codec}
+}
+
+func (c *TypedCache[T]) decode(data []byte, flags uint32) (T, error) {
+	var value T
+	if flags&codecFlags != uint32(c.codec.ID()) {
+		return value, ErrCodecMismatch
+	}
+	err := c.codec.Unmarshal(data, &value)
+	return value, err
+}
+
+// Get returns the value of key. It returns memalpha.ErrCacheMiss if key is absent.
+func (c *TypedCache[T]) Get(key string) (T, error) {
+	data, flags, err := c.conn.Get(key)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return c.decode(data, flags)
+}
+
+// GetMulti returns the values of the keys which are present. Like Get, it fails if any
+// item cannot be decoded.
+func (c *TypedCache[T]) GetMulti(keys []string) (map[string]T, error) {
+	m, err := c.conn.Gets(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]T, len(m))
+	for key, response := range m {
+		value, err := c.decode(response.Value, response.Flags)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// Set stores value under key. A zero ttl means the item never expires.
+func (c *TypedCache[T]) Set(key string, value T, ttl time.Duration) error {
+	data, err := c.codec.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return c.conn.Set(key, data, uint32(c.codec.ID()), memalpha.Exptime(ttl), false)
+}
@@ -0,0 +1,66 @@
+package codec
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+)
+
+type user struct {
+	ID   int
+	Name string
+	Tags []string
+}
+
+func TestTypedCache(t *testing.T) {
+	for _, codec := range []Codec{JSON, Gob} {
+		c := NewTypedCache[user](memdtest.NewFakeConn(), codec)
+
+		alice := user{ID: 1, Name: "alice", Tags: []string{"admin"}}
+		bob := user{ID: 2, Name: "bob"}
+
+		err := c.Set("user:1", alice, 0)
+		assert.NoError(t, err, "codec %d: set(user:1)", codec.ID())
+		err = c.Set("user:2", bob, time.Minute)
+		assert.NoError(t, err, "codec %d: set(user:2)", codec.ID())
+
+		got, err := c.Get("user:1")
+		assert.NoError(t, err, "codec %d: get(user:1)", codec.ID())
+		assert.Equal(t, alice, got, "codec %d: get(user:1)", codec.ID())
+
+		_, err = c.Get("user:3")
+		assert.Equal(t, memalpha.ErrCacheMiss, err, "codec %d: get(user:3)", codec.ID())
+
+		m, err := c.GetMulti([]string{"user:1", "user:2", "user:3"})
+		assert.NoError(t, err, "codec %d: getmulti", codec.ID())
+		assert.Equal(t, map[string]user{"user:1": alice, "user:2": bob}, m, "codec %d: getmulti", codec.ID())
+	}
+}
+
+func TestCodecMismatch(t *testing.T) {
+	conn := memdtest.NewFakeConn()
+	err := NewTypedCache[string](conn, JSON).Set("foo", "bar", 0)
+	assert.NoError(t, err)
+
+	c := NewTypedCache[string](conn, Gob)
+	_, err = c.Get("foo")
+	assert.Equal(t, ErrCodecMismatch, err)
+	_, err = c.GetMulti([]string{"foo"})
+	assert.Equal(t, ErrCodecMismatch, err)
+
+	// Raw values written without a codec are rejected as well.
+	err = conn.Set("raw", []byte(`"bar"`), 0, 0, false)
+	assert.NoError(t, err)
+	_, err = NewTypedCache[string](conn, JSON).Get("raw")
+	assert.Equal(t, ErrCodecMismatch, err)
+
+	// Flag bits above the codec ID belong to wrappers of the Conn.
+	err = conn.Set("wrapped", []byte(`"bar"`), 1<<31|uint32(IDJSON), 0, false)
+	assert.NoError(t, err)
+	value, err := NewTypedCache[string](conn, JSON).Get("wrapped")
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", value)
+}
@@ -0,0 +1,295 @@
+// Package compress provides a memalpha.Conn wrapper which transparently compresses large
+// values.
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ttakezawa/memalpha"
+)
+
+// FlagCompressed is the bit of the item flags reserved to mark a compressed value. Values
+// stored through Conn must not use this bit themselves.
+const FlagCompressed uint32 = 1 << 31
+
+// DefaultThreshold is the value size above which values are compressed by default.
+const DefaultThreshold = 1024
+
+// DefaultMaxValueSize is the default limit of decompressed values. It guards readers
+// against values crafted to expand enormously.
+const DefaultMaxValueSize = 64 << 20
+
+// Algorithm is a compression algorithm. It is stored as the first byte of a compressed
+// value, so that readers can decompress values regardless of their own Algorithm.
+type Algorithm byte
+
+// Supported algorithms.
+const (
+	Gzip Algorithm = iota + 1
+	Zstd
+	Snappy
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	case Snappy:
+		return "snappy"
+	}
+	return fmt.Sprintf("Algorithm(%d)", byte(a))
+}
+
+// ErrReservedFlag means that the caller tried to store flags overlapping FlagCompressed.
+var ErrReservedFlag = fmt.Errorf("memcache: flags must not contain the reserved bit %#x", FlagCompressed)
+
+// errTooLarge means a value would decompress beyond the limit of Conn.
+var errTooLarge = errors.New("value too large")
+
+// CorruptError means a value marked as compressed could not be decompressed.
+type CorruptError string
+
+func (ce CorruptError) Error() string {
+	return fmt.Sprintf("memcache: corrupt compressed value: %s", string(ce))
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+)
+
+func initZstd() {
+	// Errors only happen with invalid options.
+	zstdEncoder, _ = zstd.NewWriter(nil)
+}
+
+func encode(algorithm Algorithm, value []byte) ([]byte, error) {
+	dst := []byte{byte(algorithm)}
+	switch algorithm {
+	case Gzip:
+		buf := bytes.NewBuffer(dst)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(value); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		zstdOnce.Do(initZstd)
+		return zstdEncoder.EncodeAll(value, dst), nil
+	case Snappy:
+		return append(dst, snappy.Encode(nil, value)...), nil
+	}
+	return nil, fmt.Errorf("memcache: unknown compression algorithm: %v", algorithm)
+}
+
+// decode decompresses data, failing if the value would be larger than MaxValueSize.
+func (c *Conn) decode(data []byte) ([]byte, error) {
+	maxSize := c.MaxValueSize
+	if len(data) == 0 {
+		return nil, CorruptError("empty value")
+	}
+
+	algorithm, payload := Algorithm(data[0]), data[1:]
+	var value []byte
+	var err error
+	switch algorithm {
+	case Gzip:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(payload)); err == nil {
+			value, err = ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+			if err == nil && len(value) > maxSize {
+				err = errTooLarge
+			}
+		}
+	case Zstd:
+		var d *zstd.Decoder
+		if d, err = c.zstdDecoder(maxSize); err == nil {
+			value, err = d.DecodeAll(payload, nil)
+		}
+	case Snappy:
+		var n int
+		if n, err = snappy.DecodedLen(payload); err == nil {
+			if n > maxSize {
+				err = errTooLarge
+			} else {
+				value, err = snappy.Decode(nil, payload)
+			}
+		}
+	default:
+		return nil, CorruptError(fmt.Sprintf("unknown algorithm: %v", algorithm))
+	}
+	if err != nil {
+		return nil, CorruptError(fmt.Sprintf("%v: %v", algorithm, err))
+	}
+	return value, nil
+}
+
+// Conn wraps a memalpha.Conn. Values larger than the threshold are compressed by
+// Set, Add, Replace and CompareAndSwap, and Get and Gets decompress them again.
+//
+// Append and Prepend are passed through untouched. Do not use them on keys whose value
+// may have been compressed.
+type Conn struct {
+	memalpha.Conn
+	algorithm Algorithm
+	threshold int
+
+	// MaxValueSize is the largest value which is decompressed. Larger values are
+	// reported as corrupt.
+	MaxValueSize int
+
+	// zstd decodes values of at most zstdSize bytes. It is created on first use.
+	mu       sync.Mutex
+	zstd     *zstd.Decoder
+	zstdSize int
+}
+
+// NewConn returns a Conn compressing values larger than threshold bytes with algorithm.
+func NewConn(c memalpha.Conn, algorithm Algorithm, threshold int) *Conn {
+	return &Conn{
+		Conn:         c,
+		algorithm:    algorithm,
+		threshold:    threshold,
+		MaxValueSize: DefaultMaxValueSize,
+	}
+}
+
+// zstdDecoder returns a decoder refusing to decode more than maxSize bytes. The decoder
+// is replaced when MaxValueSize changes.
+func (c *Conn) zstdDecoder(maxSize int) (*zstd.Decoder, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.zstd != nil && c.zstdSize == maxSize {
+		return c.zstd, nil
+	}
+	d, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(uint64(maxSize)))
+	if err != nil {
+		return nil, err
+	}
+	if c.zstd != nil {
+		c.zstd.Close()
+	}
+	c.zstd, c.zstdSize = d, maxSize
+	return d, nil
+}
+
+// Close closes the connection and releases the zstd decoder.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.zstd != nil {
+		c.zstd.Close()
+		c.zstd = nil
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// compress returns the value and flags to be sent to the server.
+func (c *Conn) compress(value []byte, flags uint32) ([]byte, uint32, error) {
+	if flags&FlagCompressed != 0 {
+		return nil, 0, ErrReservedFlag
+	}
+	if len(value) <= c.threshold {
+		return value, flags, nil
+	}
+
+	compressed, err := encode(c.algorithm, value)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(compressed) >= len(value) {
+		// Incompressible. Keep the original to save CPU on reads.
+		return value, flags, nil
+	}
+	return compressed, flags | FlagCompressed, nil
+}
+
+// decompress returns the original value and flags of an item read from the server.
+func (c *Conn) decompress(value []byte, flags uint32) ([]byte, uint32, error) {
+	if flags&FlagCompressed == 0 {
+		return value, flags, nil
+	}
+	value, err := c.decode(value)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, flags &^ FlagCompressed, nil
+}
+
+// Get returns a value, flags and error.
+func (c *Conn) Get(key string) (value []byte, flags uint32, err error) {
+	value, flags, err = c.Conn.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return c.decompress(value, flags)
+}
+
+// Gets is an alternative get command for using with CAS. Like Get, it fails with a
+// CorruptError if an item cannot be decompressed.
+func (c *Conn) Gets(keys []string) (map[string]*memalpha.Response, error) {
+	m, err := c.Conn.Gets(keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, response := range m {
+		response.Value, response.Flags, err = c.decompress(response.Value, response.Flags)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Set means "store this data".
+func (c *Conn) Set(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	value, flags, err := c.compress(value, flags)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Set(key, value, flags, exptime, noreply)
+}
+
+// Add means "store this data, but only if the server *doesn't* already hold data for this
+// key".
+func (c *Conn) Add(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	value, flags, err := c.compress(value, flags)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Add(key, value, flags, exptime, noreply)
+}
+
+// Replace means "store this data, but only if the server *does* already hold data for
+// this key".
+func (c *Conn) Replace(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	value, flags, err := c.compress(value, flags)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Replace(key, value, flags, exptime, noreply)
+}
+
+// CompareAndSwap is a check and set operation which means "store this data but only if no
+// one else has updated since I last fetched it."
+func (c *Conn) CompareAndSwap(key string, value []byte, casid uint64, flags uint32, exptime int, noreply bool) error {
+	value, flags, err := c.compress(value, flags)
+	if err != nil {
+		return err
+	}
+	return c.Conn.CompareAndSwap(key, value, casid, flags, exptime, noreply)
+}
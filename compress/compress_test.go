@@ -0,0 +1,114 @@
+package compress
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+)
+
+func TestRoundTrip(t *testing.T) {
+	large := bytes.Repeat([]byte("compressible "), 1000)
+
+	for _, algorithm := range []Algorithm{Gzip, Zstd, Snappy} {
+		backend := memdtest.NewFakeConn()
+		c := NewConn(backend, algorithm, DefaultThreshold)
+
+		err := c.Set("small", []byte("val"), 42, 0, false)
+		assert.NoError(t, err, "%v: set(small)", algorithm)
+		raw, flags, err := backend.Get("small")
+		assert.NoError(t, err, "%v: raw get(small)", algorithm)
+		assert.Equal(t, []byte("val"), raw, "%v: small values are stored as is", algorithm)
+		assert.EqualValues(t, 42, flags, "%v: raw get(small)", algorithm)
+
+		err = c.Set("large", large, 42, 0, false)
+		assert.NoError(t, err, "%v: set(large)", algorithm)
+		raw, flags, err = backend.Get("large")
+		assert.NoError(t, err, "%v: raw get(large)", algorithm)
+		assert.True(t, len(raw) < len(large), "%v: large values are compressed", algorithm)
+		assert.Equal(t, byte(algorithm), raw[0], "%v: raw get(large)", algorithm)
+		assert.Equal(t, 42|FlagCompressed, flags, "%v: raw get(large)", algorithm)
+
+		value, flags, err := c.Get("large")
+		assert.NoError(t, err, "%v: get(large)", algorithm)
+		assert.Equal(t, large, value, "%v: get(large)", algorithm)
+		assert.EqualValues(t, 42, flags, "%v: get(large)", algorithm)
+
+		m, err := c.Gets([]string{"small", "large"})
+		assert.NoError(t, err, "%v: gets(small, large)", algorithm)
+		assert.Equal(t, []byte("val"), m["small"].Value, "%v: gets(small, large)", algorithm)
+		assert.Equal(t, large, m["large"].Value, "%v: gets(small, large)", algorithm)
+		assert.EqualValues(t, 42, m["large"].Flags, "%v: gets(small, large)", algorithm)
+
+		err = c.CompareAndSwap("large", large[1:], m["large"].CasID, 0, 0, false)
+		assert.NoError(t, err, "%v: cas(large)", algorithm)
+		value, _, err = c.Get("large")
+		assert.NoError(t, err, "%v: get(large)", algorithm)
+		assert.Equal(t, large[1:], value, "%v: get(large)", algorithm)
+	}
+}
+
+func TestIncompressible(t *testing.T) {
+	backend := memdtest.NewFakeConn()
+	c := NewConn(backend, Snappy, 4)
+
+	value := []byte("\x00\x01\x02\x03\x04\x05")
+	err := c.Set("foo", value, 0, 0, false)
+	assert.NoError(t, err)
+	_, flags, err := backend.Get("foo")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, flags)
+}
+
+func TestReservedFlag(t *testing.T) {
+	c := NewConn(memdtest.NewFakeConn(), Gzip, DefaultThreshold)
+	err := c.Set("foo", []byte("bar"), FlagCompressed, 0, false)
+	assert.Equal(t, ErrReservedFlag, err)
+}
+
+func TestCorruptValue(t *testing.T) {
+	backend := memdtest.NewFakeConn()
+	c := NewConn(backend, Gzip, DefaultThreshold)
+	assert.NoError(t, backend.Set("bar", []byte("val"), 0, 0, false))
+
+	for _, value := range [][]byte{
+		nil,
+		[]byte("\xffunknown algorithm"),
+		append([]byte{byte(Gzip)}, "not gzip"...),
+		append([]byte{byte(Zstd)}, "not zstd"...),
+		append([]byte{byte(Snappy)}, "\xff\xff\xff\xff"...),
+	} {
+		err := backend.Set("foo", value, FlagCompressed, 0, false)
+		assert.NoError(t, err)
+
+		_, _, err = c.Get("foo")
+		assert.IsType(t, CorruptError(""), err, "get(%q)", value)
+
+		_, err = c.Gets([]string{"foo", "bar"})
+		assert.IsType(t, CorruptError(""), err, "gets(%q)", value)
+	}
+
+	_, _, err := c.Get("not_exists")
+	assert.Equal(t, memalpha.ErrCacheMiss, err)
+}
+
+func TestMaxValueSize(t *testing.T) {
+	large := bytes.Repeat([]byte{0}, 1<<20)
+
+	for _, algorithm := range []Algorithm{Gzip, Zstd, Snappy} {
+		backend := memdtest.NewFakeConn()
+		c := NewConn(backend, algorithm, DefaultThreshold)
+		assert.NoError(t, c.Set("large", large, 0, 0, false), "%v: set(large)", algorithm)
+
+		value, _, err := c.Get("large")
+		assert.NoError(t, err, "%v: get(large)", algorithm)
+		assert.Len(t, value, len(large), "%v: get(large)", algorithm)
+
+		c.MaxValueSize = len(large) - 1
+		_, _, err = c.Get("large")
+		assert.IsType(t, CorruptError(""), err, "%v: get(large) over MaxValueSize", algorithm)
+		assert.NoError(t, c.Close(), "%v: close", algorithm)
+	}
+}
@@ -0,0 +1,403 @@
+// Package conntest provides a conformance test suite for memalpha.Conn implementations.
+//
+// The suite checks the behavior of memcached as seen through the Conn interface:
+// storage and retrieval, error mapping, CAS semantics, noreply, expirations and
+// binary-safe values. Protocol implementations and wrappers can run it to prove that
+// they are interchangeable:
+//
+//	func TestConformance(t *testing.T) {
+//		conntest.Run(t, func() (memalpha.Conn, error) {
+//			return textproto.Dial("localhost:11211")
+//		})
+//	}
+package conntest
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+type suite struct {
+	dial    func() (memalpha.Conn, error)
+	advance func(d time.Duration)
+}
+
+// Run runs the suite against the connections returned by dial. Every test flushes all
+// the items of the server. A server with a fake clock passes advance, which moves the
+// clock forward by d; otherwise the suite sleeps.
+func Run(t *testing.T, dial func() (memalpha.Conn, error), advance ...func(d time.Duration)) {
+	s := &suite{dial: dial, advance: time.Sleep}
+	if len(advance) > 0 {
+		s.advance = advance[0]
+	}
+
+	tests := []struct {
+		name string
+		f    func(t *testing.T, c memalpha.Conn)
+	}{
+		{"SetGet", testSetGet},
+		{"Gets", testGets},
+		{"AddReplace", testAddReplace},
+		{"AppendPrepend", testAppendPrepend},
+		{"CompareAndSwap", testCompareAndSwap},
+		{"Delete", testDelete},
+		{"IncrementDecrement", testIncrementDecrement},
+		{"Noreply", testNoreply},
+		{"BinarySafe", testBinarySafe},
+		{"Expiration", s.testExpiration},
+		{"FlushAll", testFlushAll},
+		{"StatsVersion", testStatsVersion},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			c, err := s.dial()
+			if err != nil {
+				t.Fatalf("dial: %s", err)
+			}
+			defer func() { _ = c.Close() }()
+			if err := c.FlushAll(0, false); err != nil {
+				t.Fatalf("flush_all: %s", err)
+			}
+			test.f(t, c)
+		})
+	}
+}
+
+// noError reports an unexpected error of what, and whether there was none.
+func noError(t *testing.T, err error, what string) bool {
+	t.Helper()
+	if err != nil {
+		t.Errorf("%s: unexpected error: %v", what, err)
+		return false
+	}
+	return true
+}
+
+// isError reports an error of what other than want.
+func isError(t *testing.T, err error, want error, what string) {
+	t.Helper()
+	if err != want {
+		t.Errorf("%s: got error %v, want %v", what, err, want)
+	}
+}
+
+func isClientError(t *testing.T, err error, what string) {
+	t.Helper()
+	if _, ok := err.(memalpha.ClientError); !ok {
+		t.Errorf("%s: got error %v, want a memalpha.ClientError", what, err)
+	}
+}
+
+func isValue(t *testing.T, n uint64, want uint64, what string) {
+	t.Helper()
+	if n != want {
+		t.Errorf("%s = %d, want %d", what, n, want)
+	}
+}
+
+func assertItem(t *testing.T, c memalpha.Conn, key string, value string, flags uint32) {
+	t.Helper()
+	v, f, err := c.Get(key)
+	if !noError(t, err, "get("+key+")") {
+		return
+	}
+	if string(v) != value {
+		t.Errorf("get(%s) = %q, want %q", key, v, value)
+	}
+	if f != flags {
+		t.Errorf("flags of get(%s) = %d, want %d", key, f, flags)
+	}
+}
+
+func assertMiss(t *testing.T, c memalpha.Conn, key string) {
+	t.Helper()
+	_, _, err := c.Get(key)
+	isError(t, err, memalpha.ErrCacheMiss, "get("+key+")")
+}
+
+func casID(t *testing.T, c memalpha.Conn, key string) uint64 {
+	t.Helper()
+	m, err := c.Gets([]string{key})
+	if err != nil {
+		t.Fatalf("gets(%s): unexpected error: %v", key, err)
+	}
+	response, ok := m[key]
+	if !ok {
+		t.Fatalf("gets(%s): missing", key)
+	}
+	return response.CasID
+}
+
+func testSetGet(t *testing.T, c memalpha.Conn) {
+	assertMiss(t, c, "foo")
+
+	noError(t, c.Set("foo", []byte("bar"), 0, 0, false), "set")
+	assertItem(t, c, "foo", "bar", 0)
+
+	noError(t, c.Set("foo", []byte("baz"), 42, 0, false), "overwrite")
+	assertItem(t, c, "foo", "baz", 42)
+
+	noError(t, c.Set("flags", []byte("x"), 0xffff, 0, false), "set(flags)")
+	assertItem(t, c, "flags", "x", 0xffff)
+}
+
+func testGets(t *testing.T, c memalpha.Conn) {
+	noError(t, c.Set("a", []byte("1"), 1, 0, false), "set(a)")
+	noError(t, c.Set("b", []byte("2"), 2, 0, false), "set(b)")
+
+	m, err := c.Gets([]string{"a", "missing", "b"})
+	noError(t, err, "gets")
+	if len(m) != 2 || m["a"] == nil || m["b"] == nil {
+		t.Errorf("gets = %v, want a and b only: missing keys are omitted", m)
+	} else {
+		if string(m["a"].Value) != "1" || m["a"].Flags != 1 {
+			t.Errorf("gets: a = %q with flags %d, want \"1\" with flags 1", m["a"].Value, m["a"].Flags)
+		}
+		if string(m["b"].Value) != "2" || m["b"].Flags != 2 {
+			t.Errorf("gets: b = %q with flags %d, want \"2\" with flags 2", m["b"].Value, m["b"].Flags)
+		}
+		if m["a"].CasID == m["b"].CasID {
+			t.Errorf("gets: cas uniques of a and b are both %d", m["a"].CasID)
+		}
+	}
+
+	m, err = c.Gets([]string{"missing"})
+	noError(t, err, "gets(missing): no hit is not an error")
+	if len(m) != 0 {
+		t.Errorf("gets(missing) = %v, want empty", m)
+	}
+}
+
+func testAddReplace(t *testing.T, c memalpha.Conn) {
+	isError(t, c.Replace("foo", []byte("x"), 0, 0, false), memalpha.ErrNotStored, "replace(missing)")
+	assertMiss(t, c, "foo")
+
+	noError(t, c.Add("foo", []byte("added"), 1, 0, false), "add")
+	isError(t, c.Add("foo", []byte("x"), 0, 0, false), memalpha.ErrNotStored, "add(existing)")
+	assertItem(t, c, "foo", "added", 1)
+
+	noError(t, c.Replace("foo", []byte("replaced"), 2, 0, false), "replace")
+	assertItem(t, c, "foo", "replaced", 2)
+}
+
+func testAppendPrepend(t *testing.T, c memalpha.Conn) {
+	isError(t, c.Append("foo", []byte("x"), false), memalpha.ErrNotStored, "append(missing)")
+	isError(t, c.Prepend("foo", []byte("x"), false), memalpha.ErrNotStored, "prepend(missing)")
+	assertMiss(t, c, "foo")
+
+	noError(t, c.Set("foo", []byte("bar"), 42, 0, false), "set")
+	noError(t, c.Append("foo", []byte(">"), false), "append")
+	noError(t, c.Prepend("foo", []byte("<"), false), "prepend")
+	assertItem(t, c, "foo", "<bar>", 42)
+}
+
+func testCompareAndSwap(t *testing.T, c memalpha.Conn) {
+	isError(t, c.CompareAndSwap("foo", []byte("x"), 1, 0, 0, false), memalpha.ErrNotFound, "cas(missing)")
+
+	noError(t, c.Set("foo", []byte("v1"), 0, 0, false), "set")
+	casid := casID(t, c, "foo")
+	if again := casID(t, c, "foo"); again != casid {
+		t.Errorf("cas unique changed from %d to %d by a read", casid, again)
+	}
+
+	noError(t, c.CompareAndSwap("foo", []byte("v2"), casid, 7, 0, false), "cas")
+	assertItem(t, c, "foo", "v2", 7)
+	isError(t, c.CompareAndSwap("foo", []byte("v3"), casid, 0, 0, false), memalpha.ErrCasConflict,
+		"cas after a successful cas")
+	assertItem(t, c, "foo", "v2", 7)
+
+	modifications := []struct {
+		name   string
+		modify func() error
+	}{
+		{"set", func() error { return c.Set("foo", []byte("1"), 0, 0, false) }},
+		{"append", func() error { return c.Append("foo", []byte("0"), false) }},
+		{"prepend", func() error { return c.Prepend("foo", []byte("1"), false) }},
+		{"replace", func() error { return c.Replace("foo", []byte("2"), 0, 0, false) }},
+		{"increment", func() error { _, err := c.Increment("foo", 1, false); return err }},
+	}
+	for _, m := range modifications {
+		casid = casID(t, c, "foo")
+		noError(t, m.modify(), m.name)
+		isError(t, c.CompareAndSwap("foo", []byte("x"), casid, 0, 0, false), memalpha.ErrCasConflict,
+			"cas after "+m.name)
+	}
+
+	casid = casID(t, c, "foo")
+	noError(t, c.Delete("foo", false), "delete")
+	isError(t, c.CompareAndSwap("foo", []byte("x"), casid, 0, 0, false), memalpha.ErrNotFound, "cas after delete")
+}
+
+func testDelete(t *testing.T, c memalpha.Conn) {
+	isError(t, c.Delete("foo", false), memalpha.ErrNotFound, "delete(missing)")
+
+	noError(t, c.Set("foo", []byte("bar"), 0, 0, false), "set")
+	noError(t, c.Delete("foo", false), "delete")
+	assertMiss(t, c, "foo")
+	isError(t, c.Delete("foo", false), memalpha.ErrNotFound, "delete(deleted)")
+}
+
+func testIncrementDecrement(t *testing.T, c memalpha.Conn) {
+	_, err := c.Increment("n", 1, false)
+	isError(t, err, memalpha.ErrNotFound, "incr(missing)")
+	_, err = c.Decrement("n", 1, false)
+	isError(t, err, memalpha.ErrNotFound, "decr(missing)")
+
+	noError(t, c.Set("n", []byte("35"), 5, 0, false), "set")
+	n, err := c.Increment("n", 7, false)
+	noError(t, err, "incr")
+	isValue(t, n, 42, "incr")
+	n, err = c.Decrement("n", 40, false)
+	noError(t, err, "decr")
+	isValue(t, n, 2, "decr")
+	assertItem(t, c, "n", "2", 5)
+
+	n, err = c.Decrement("n", 100, false)
+	noError(t, err, "decr below 0")
+	isValue(t, n, 0, "decr below 0: decrement stops at 0")
+
+	noError(t, c.Set("n", []byte("18446744073709551615"), 0, 0, false), "set")
+	n, err = c.Increment("n", 2, false)
+	noError(t, err, "incr over 64 bits")
+	isValue(t, n, 1, "incr over 64 bits: increment wraps around")
+
+	noError(t, c.Set("s", []byte("abc"), 0, 0, false), "set")
+	_, err = c.Increment("s", 1, false)
+	isClientError(t, err, "incr(non-numeric value)")
+	assertItem(t, c, "s", "abc", 0)
+}
+
+func testNoreply(t *testing.T, c memalpha.Conn) {
+	// Failures aren't reported with noreply.
+	noError(t, c.Replace("foo", []byte("x"), 0, 0, true), "replace")
+	noError(t, c.Append("foo", []byte("x"), true), "append")
+	noError(t, c.Prepend("foo", []byte("x"), true), "prepend")
+	noError(t, c.CompareAndSwap("foo", []byte("x"), 1, 0, 0, true), "cas")
+	noError(t, c.Delete("foo", true), "delete")
+	_, err := c.Increment("foo", 1, true)
+	noError(t, err, "incr")
+	_, err = c.Decrement("foo", 1, true)
+	noError(t, err, "decr")
+	noError(t, c.Touch("foo", 10, true), "touch")
+	assertMiss(t, c, "foo")
+
+	// But the commands take effect.
+	noError(t, c.Set("foo", []byte("1"), 0, 0, true), "set")
+	noError(t, c.Add("foo", []byte("x"), 0, 0, true), "add(existing)")
+	noError(t, c.Add("bar", []byte("2"), 0, 0, true), "add")
+	assertItem(t, c, "foo", "1", 0)
+	assertItem(t, c, "bar", "2", 0)
+
+	_, err = c.Increment("foo", 10, true)
+	noError(t, err, "incr")
+	_, err = c.Decrement("foo", 1, true)
+	noError(t, err, "decr")
+	noError(t, c.Append("foo", []byte("0"), true), "append")
+	noError(t, c.Prepend("foo", []byte("1"), true), "prepend")
+	assertItem(t, c, "foo", "1100", 0)
+
+	casid := casID(t, c, "foo")
+	noError(t, c.CompareAndSwap("foo", []byte("swapped"), casid, 0, 0, true), "cas")
+	noError(t, c.Replace("bar", []byte("replaced"), 0, 0, true), "replace")
+	assertItem(t, c, "foo", "swapped", 0)
+	assertItem(t, c, "bar", "replaced", 0)
+
+	noError(t, c.Delete("foo", true), "delete")
+	assertMiss(t, c, "foo")
+}
+
+func testBinarySafe(t *testing.T, c memalpha.Conn) {
+	var all []byte
+	for i := 0; i < 256; i++ {
+		all = append(all, byte(i))
+	}
+	values := map[string][]byte{
+		"empty":    {},
+		"all":      all,
+		"protocol": []byte("\r\nEND\r\nVALUE foo 0 3\r\nbar\r\n"),
+		"large":    bytes.Repeat(all, 512*1024/len(all)),
+	}
+
+	for key, value := range values {
+		noError(t, c.Set(key, value, 0, 0, false), "set("+key+")")
+	}
+	for key, value := range values {
+		v, _, err := c.Get(key)
+		if noError(t, err, "get("+key+")") && !bytes.Equal(value, v) {
+			t.Errorf("get(%s) differs from the value set", key)
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	m, err := c.Gets(keys)
+	noError(t, err, "gets")
+	for key, value := range values {
+		if response, ok := m[key]; !ok {
+			t.Errorf("gets: %s is missing", key)
+		} else if !bytes.Equal(value, response.Value) {
+			t.Errorf("gets: %s differs from the value set", key)
+		}
+	}
+
+	noError(t, c.Append("all", []byte("\r\n"), false), "append")
+	v, _, err := c.Get("all")
+	if noError(t, err, "get(all)") && !bytes.Equal(append(all, '\r', '\n'), v) {
+		t.Errorf("get(all) differs from the value appended to")
+	}
+}
+
+func (s *suite) testExpiration(t *testing.T, c memalpha.Conn) {
+	// The short lived items live for at least a second even on a real server whose clock
+	// ticks by seconds, so that they can be checked right after being stored.
+	noError(t, c.Set("short", []byte("x"), 0, 2, false), "set(short)")
+	noError(t, c.Set("touched", []byte("x"), 0, 2, false), "set(touched)")
+	noError(t, c.Set("forever", []byte("x"), 0, 0, false), "set(forever)")
+	noError(t, c.Set("absolute", []byte("x"), 0, int(time.Now().Add(time.Hour).Unix()), false), "set(absolute)")
+	noError(t, c.Set("negative", []byte("x"), 0, -1, false), "set(negative)")
+	assertMiss(t, c, "negative")
+	assertItem(t, c, "short", "x", 0)
+
+	noError(t, c.Touch("touched", 100, false), "touch")
+	isError(t, c.Touch("missing", 100, false), memalpha.ErrNotFound, "touch(missing)")
+
+	// Expirations have a resolution of one second.
+	s.advance(3 * time.Second)
+	assertMiss(t, c, "short")
+	assertItem(t, c, "touched", "x", 0)
+	assertItem(t, c, "forever", "x", 0)
+	assertItem(t, c, "absolute", "x", 0)
+
+	noError(t, c.Touch("touched", -1, false), "touch(touched)")
+	assertMiss(t, c, "touched")
+}
+
+func testFlushAll(t *testing.T, c memalpha.Conn) {
+	noError(t, c.Set("a", []byte("1"), 0, 0, false), "set(a)")
+	noError(t, c.Set("b", []byte("2"), 0, 0, false), "set(b)")
+	noError(t, c.FlushAll(0, false), "flush_all")
+	assertMiss(t, c, "a")
+	assertMiss(t, c, "b")
+
+	noError(t, c.Set("a", []byte("1"), 0, 0, false), "set(a)")
+	assertItem(t, c, "a", "1", 0)
+}
+
+func testStatsVersion(t *testing.T, c memalpha.Conn) {
+	stats, err := c.Stats("")
+	if noError(t, err, "stats") && len(stats) == 0 {
+		t.Errorf("stats is empty")
+	}
+
+	version, err := c.Version()
+	if noError(t, err, "version") && version == "" {
+		t.Errorf("version is empty")
+	}
+}
@@ -0,0 +1,112 @@
+package memalpha
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// ErrCounterLimit means a Counter update would have exceeded its maximum.
+var ErrCounterLimit = errors.New("memcache: counter limit exceeded")
+
+// counterAttempts is the number of times a Counter retries when the key disappears or is
+// created by another client in the middle of an update.
+const counterAttempts = 5
+
+// Counter is a numeric item which is created on the first update, so that callers do not
+// have to race "add" against "incr" themselves.
+type Counter struct {
+	conn Conn
+	key  string
+
+	// Initial is the value the counter starts from before the first delta is applied.
+	Initial uint64
+
+	// TTL is the time to live given to the item when it is created. Updates do not extend
+	// it. Zero means the item never expires.
+	TTL time.Duration
+
+	// Max is the largest allowed value. Zero means no limit. An increment going over Max
+	// is reverted by a decrement, so the bound is best-effort: concurrent callers may
+	// briefly see values above Max, and the overshoot stays if the decrement fails.
+	Max uint64
+}
+
+// NewCounter creates a Counter stored under key, which expires ttl after its creation.
+func NewCounter(conn Conn, key string, ttl time.Duration) *Counter {
+	return &Counter{conn: conn, key: key, TTL: ttl}
+}
+
+// Add adds delta to the counter and returns the new value. A negative delta never brings
+// the value below 0. If the new value would exceed Max, the counter is left unchanged and
+// ErrCounterLimit is returned.
+func (c *Counter) Add(delta int64) (uint64, error) {
+	for i := 0; i < counterAttempts; i++ {
+		value, err := c.update(delta)
+		if err != ErrNotFound {
+			return value, err
+		}
+
+		value = applyDelta(c.Initial, delta)
+		if c.Max != 0 && value > c.Max {
+			return 0, ErrCounterLimit
+		}
+		err = c.conn.Add(c.key, strconv.AppendUint(nil, value, 10), 0, Exptime(c.TTL), false)
+		if err != ErrNotStored {
+			return value, err
+		}
+		// Another client created it first. Update it instead.
+	}
+	return 0, ErrNotFound
+}
+
+func (c *Counter) update(delta int64) (uint64, error) {
+	if delta < 0 {
+		return c.conn.Decrement(c.key, uint64(-delta), false)
+	}
+
+	value, err := c.conn.Increment(c.key, uint64(delta), false)
+	if err != nil {
+		return 0, err
+	}
+	if c.Max != 0 && value > c.Max {
+		// Revert our own increment.
+		if _, err = c.conn.Decrement(c.key, uint64(delta), false); err != nil && err != ErrNotFound {
+			return 0, err
+		}
+		return 0, ErrCounterLimit
+	}
+	return value, nil
+}
+
+func applyDelta(value uint64, delta int64) uint64 {
+	if delta >= 0 {
+		return value + uint64(delta)
+	}
+	if uint64(-delta) > value {
+		return 0
+	}
+	return value - uint64(-delta)
+}
+
+// Value returns the current value. A counter which does not exist yet has the value
+// Initial.
+func (c *Counter) Value() (uint64, error) {
+	value, _, err := c.conn.Get(c.key)
+	if err == ErrCacheMiss {
+		return c.Initial, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(value), 10, 64)
+}
+
+// Reset deletes the counter, so that it starts over from Initial.
+func (c *Counter) Reset() error {
+	err := c.conn.Delete(c.key, false)
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
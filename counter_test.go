@@ -0,0 +1,109 @@
+package memalpha_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+)
+
+func TestCounter(t *testing.T) {
+	conn := memdtest.NewFakeConn()
+	c := memalpha.NewCounter(conn, "hits", 0)
+
+	value, err := c.Value()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, value, "value of a missing counter")
+
+	value, err = c.Add(5)
+	assert.NoError(t, err, "add(5) creates the counter")
+	assert.EqualValues(t, 5, value)
+
+	value, err = c.Add(2)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 7, value)
+
+	value, err = c.Add(-10)
+	assert.NoError(t, err, "decrement floors at zero")
+	assert.EqualValues(t, 0, value)
+
+	err = c.Reset()
+	assert.NoError(t, err)
+	err = c.Reset()
+	assert.NoError(t, err, "reset a missing counter")
+
+	c.Initial = 10
+	value, err = c.Add(-3)
+	assert.NoError(t, err, "add(-3) creates the counter from Initial")
+	assert.EqualValues(t, 7, value)
+	value, err = c.Value()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 7, value)
+}
+
+func TestCounterMax(t *testing.T) {
+	conn := memdtest.NewFakeConn()
+	c := memalpha.NewCounter(conn, "quota", 0)
+	c.Max = 3
+
+	_, err := c.Add(4)
+	assert.Equal(t, memalpha.ErrCounterLimit, err, "creation above Max")
+
+	for i := 1; i <= 3; i++ {
+		value, err := c.Add(1)
+		assert.NoError(t, err)
+		assert.EqualValues(t, i, value)
+	}
+
+	_, err = c.Add(1)
+	assert.Equal(t, memalpha.ErrCounterLimit, err, "increment above Max")
+	value, err := c.Value()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, value, "the counter is left unchanged")
+}
+
+func TestCounterTTL(t *testing.T) {
+	clock := memdtest.NewClock(time.Unix(1000, 0))
+	conn := memdtest.NewFakeConn()
+	conn.Now = clock.Now
+	c := memalpha.NewCounter(conn, "hits", 10*time.Second)
+
+	_, err := c.Add(1)
+	assert.NoError(t, err)
+	clock.Advance(5 * time.Second)
+	value, err := c.Add(1)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, value)
+
+	clock.Advance(6 * time.Second)
+	value, err = c.Value()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, value, "updates don't extend the ttl")
+}
+
+func TestCounterRace(t *testing.T) {
+	// Another client creates the counter between our incr and add.
+	conn := &racingConn{FakeConn: memdtest.NewFakeConn()}
+	c := memalpha.NewCounter(conn, "hits", 0)
+
+	value, err := c.Add(1)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 101, value)
+}
+
+type racingConn struct {
+	*memdtest.FakeConn
+	raced bool
+}
+
+func (c *racingConn) Add(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	if !c.raced {
+		c.raced = true
+		if err := c.FakeConn.Set(key, []byte("100"), 0, 0, false); err != nil {
+			return err
+		}
+	}
+	return c.FakeConn.Add(key, value, flags, exptime, noreply)
+}
@@ -45,4 +45,8 @@ var (
 
 	// ErrReplyError means the client sent a nonexistent command name.
 	ErrReplyError = errors.New("memcache: nonexistent command name")
+
+	// ErrMalformedKey means a key is longer than 250 bytes or contains whitespace or
+	// control characters. Such a key is never sent to the server.
+	ErrMalformedKey = errors.New("memcache: malformed key")
 )
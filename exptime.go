@@ -0,0 +1,29 @@
+package memalpha
+
+import (
+	"math"
+	"time"
+)
+
+// MaxRelativeExptime is the largest exptime that memcached treats as an offset from the
+// current time. Larger values are absolute unix timestamps.
+const MaxRelativeExptime = 60 * 60 * 24 * 30
+
+// Exptime converts ttl to the exptime of storage commands, rounding up to whole seconds.
+// A ttl longer than MaxRelativeExptime seconds is sent as an absolute unix timestamp,
+// clamped to the 32 bits memcached keeps. A zero or negative ttl returns 0, which never
+// expires.
+func Exptime(ttl time.Duration) int {
+	if ttl <= 0 {
+		return 0
+	}
+	seconds := (ttl + time.Second - 1) / time.Second
+	if seconds > MaxRelativeExptime {
+		at := time.Now().Add(ttl).Unix()
+		if at > math.MaxInt32 {
+			return math.MaxInt32
+		}
+		return int(at)
+	}
+	return int(seconds)
+}
@@ -0,0 +1,24 @@
+package memalpha_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+func TestExptime(t *testing.T) {
+	assert.Equal(t, 0, memalpha.Exptime(0))
+	assert.Equal(t, 0, memalpha.Exptime(-time.Second))
+	assert.Equal(t, 1, memalpha.Exptime(time.Nanosecond))
+	assert.Equal(t, 2, memalpha.Exptime(1500*time.Millisecond))
+	assert.Equal(t, memalpha.MaxRelativeExptime, memalpha.Exptime(memalpha.MaxRelativeExptime*time.Second))
+
+	ttl := 31 * 24 * time.Hour
+	at := time.Now().Add(ttl).Unix()
+	assert.InDelta(t, at, memalpha.Exptime(ttl), 1)
+	assert.Equal(t, math.MaxInt32, memalpha.Exptime(100*365*24*time.Hour))
+}
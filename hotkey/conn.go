@@ -0,0 +1,166 @@
+package hotkey
+
+import (
+	"math/rand"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+// DefaultReplicaExptime is the default expiration time of copies on replicas. It bounds
+// how long a replica may serve a value modified by another client.
+const DefaultReplicaExptime = 10
+
+// Conn wraps a primary memalpha.Conn and feeds the keys it reads to a Detector.
+//
+// If replicas are given, hot keys are copied to them on read, and Get spreads the reads
+// of hot keys over the primary and the replicas. Writes through Conn refresh or drop the
+// copies, also once the key has cooled down, until the copies expire. Gets always reads from the primary, because cas uniques are only meaningful
+// there.
+type Conn struct {
+	memalpha.Conn
+	detector *Detector
+	replicas []memalpha.Conn
+
+	// ReplicaExptime is the expiration time of copies on replicas.
+	ReplicaExptime int
+
+	pick func(n int) int
+}
+
+// NewConn creates a Conn detecting hot keys with detector.
+func NewConn(primary memalpha.Conn, detector *Detector, replicas ...memalpha.Conn) *Conn {
+	return &Conn{
+		Conn:           primary,
+		detector:       detector,
+		replicas:       replicas,
+		ReplicaExptime: DefaultReplicaExptime,
+		pick:           rand.Intn,
+	}
+}
+
+// Detector returns the Detector of c.
+func (c *Conn) Detector() *Detector {
+	return c.detector
+}
+
+func (c *Conn) replicated(key string) bool {
+	return len(c.replicas) > 0 && c.detector.IsHot(key)
+}
+
+// Get returns a value, flags and error. A hot key is read from a random server among the
+// primary and the replicas.
+func (c *Conn) Get(key string) (value []byte, flags uint32, err error) {
+	c.detector.Observe(key)
+	if !c.replicated(key) {
+		return c.Conn.Get(key)
+	}
+
+	i := c.pick(len(c.replicas) + 1)
+	if i == 0 {
+		return c.Conn.Get(key)
+	}
+	replica := c.replicas[i-1]
+	if value, flags, err = replica.Get(key); err == nil {
+		return value, flags, nil
+	}
+
+	// Not replicated yet, or the replica failed. Fall back to the primary.
+	if value, flags, err = c.Conn.Get(key); err != nil {
+		return nil, 0, err
+	}
+	c.detector.copied(key, c.ReplicaExptime)
+	_ = replica.Set(key, value, flags, c.ReplicaExptime, true)
+	return value, flags, nil
+}
+
+// Gets is an alternative get command for using with CAS. It always reads from the primary.
+func (c *Conn) Gets(keys []string) (map[string]*memalpha.Response, error) {
+	for _, key := range keys {
+		c.detector.Observe(key)
+	}
+	return c.Conn.Gets(keys)
+}
+
+// dropReplicas deletes the copies of a key. Failures are ignored; copies expire after
+// ReplicaExptime anyway.
+func (c *Conn) dropReplicas(key string) {
+	if len(c.replicas) == 0 || !c.detector.hasCopies(key) {
+		return
+	}
+	for _, replica := range c.replicas {
+		_ = replica.Delete(key, true)
+	}
+}
+
+// Set means "store this data". Copies of a hot key are updated as well, and those of a
+// key which cooled down are dropped.
+func (c *Conn) Set(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	if err := c.Conn.Set(key, value, flags, exptime, noreply); err != nil {
+		c.dropReplicas(key)
+		return err
+	}
+	if !c.replicated(key) {
+		c.dropReplicas(key)
+	} else {
+		replicaExptime := c.ReplicaExptime
+		if exptime < 0 {
+			replicaExptime = exptime
+		}
+		c.detector.copied(key, replicaExptime)
+		for _, replica := range c.replicas {
+			_ = replica.Set(key, value, flags, replicaExptime, true)
+		}
+	}
+	return nil
+}
+
+// Add means "store this data, but only if the server *doesn't* already hold data for this
+// key".
+func (c *Conn) Add(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	defer c.dropReplicas(key)
+	return c.Conn.Add(key, value, flags, exptime, noreply)
+}
+
+// Replace means "store this data, but only if the server *does* already hold data for
+// this key".
+func (c *Conn) Replace(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	defer c.dropReplicas(key)
+	return c.Conn.Replace(key, value, flags, exptime, noreply)
+}
+
+// Append means "add this data to an existing key after existing data".
+func (c *Conn) Append(key string, value []byte, noreply bool) error {
+	defer c.dropReplicas(key)
+	return c.Conn.Append(key, value, noreply)
+}
+
+// Prepend means "add this data to an existing key before existing data".
+func (c *Conn) Prepend(key string, value []byte, noreply bool) error {
+	defer c.dropReplicas(key)
+	return c.Conn.Prepend(key, value, noreply)
+}
+
+// CompareAndSwap is a check and set operation which means "store this data but only if no
+// one else has updated since I last fetched it."
+func (c *Conn) CompareAndSwap(key string, value []byte, casid uint64, flags uint32, exptime int, noreply bool) error {
+	defer c.dropReplicas(key)
+	return c.Conn.CompareAndSwap(key, value, casid, flags, exptime, noreply)
+}
+
+// Delete deletes the item with the provided key.
+func (c *Conn) Delete(key string, noreply bool) error {
+	defer c.dropReplicas(key)
+	return c.Conn.Delete(key, noreply)
+}
+
+// Increment key by value.
+func (c *Conn) Increment(key string, value uint64, noreply bool) (uint64, error) {
+	defer c.dropReplicas(key)
+	return c.Conn.Increment(key, value, noreply)
+}
+
+// Decrement key by value.
+func (c *Conn) Decrement(key string, value uint64, noreply bool) (uint64, error) {
+	defer c.dropReplicas(key)
+	return c.Conn.Decrement(key, value, noreply)
+}
@@ -0,0 +1,185 @@
+// Package hotkey detects frequently read keys and spreads their reads over replicas.
+package hotkey
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// KeyCount is a key with its estimated number of sampled reads.
+type KeyCount struct {
+	Key   string
+	Count uint64
+}
+
+// Detector samples keys and keeps the heaviest hitters with the space-saving algorithm:
+// it tracks a fixed number of keys, and a new key replaces the key with the smallest
+// count, inheriting that count as its overestimation. Counts are halved every Window, so
+// that keys which cool down leave the top.
+type Detector struct {
+	capacity int
+
+	// SampleRate is the fraction of reads which are counted.
+	SampleRate float64
+
+	// Threshold is the count at which a key is considered hot.
+	Threshold uint64
+
+	// Window is the period after which counts are halved. Zero disables decay.
+	Window time.Duration
+
+	now       func() time.Time
+	random    func() float64
+	mu        sync.Mutex
+	counts    map[string]uint64
+	lastDecay time.Time
+
+	// copies holds the keys copied to replicas until their copies expire. The zero time
+	// never expires.
+	copies map[string]time.Time
+}
+
+// NewDetector creates a Detector tracking up to capacity keys.
+func NewDetector(capacity int, sampleRate float64, threshold uint64) *Detector {
+	return &Detector{
+		capacity:   capacity,
+		SampleRate: sampleRate,
+		Threshold:  threshold,
+		Window:     time.Minute,
+		now:        time.Now,
+		random:     rand.Float64,
+		counts:     make(map[string]uint64, capacity),
+		lastDecay:  time.Now(),
+		copies:     make(map[string]time.Time),
+	}
+}
+
+func (d *Detector) decay() {
+	if d.Window <= 0 {
+		return
+	}
+	now := d.now()
+	if now.Sub(d.lastDecay) < d.Window {
+		return
+	}
+	for key, until := range d.copies {
+		if !until.IsZero() && !now.Before(until) {
+			delete(d.copies, key)
+		}
+	}
+	for now.Sub(d.lastDecay) >= d.Window {
+		d.lastDecay = d.lastDecay.Add(d.Window)
+		for key, count := range d.counts {
+			if count /= 2; count == 0 {
+				delete(d.counts, key)
+			} else {
+				d.counts[key] = count
+			}
+		}
+		if len(d.counts) == 0 {
+			d.lastDecay = now
+		}
+	}
+}
+
+// Observe records a read of key, subject to sampling.
+func (d *Detector) Observe(key string) {
+	if d.SampleRate < 1 && d.random() >= d.SampleRate {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.decay()
+	if _, ok := d.counts[key]; ok || len(d.counts) < d.capacity {
+		d.counts[key]++
+		return
+	}
+
+	// Replace the key with the smallest count.
+	minKey, minCount := "", ^uint64(0)
+	for k, count := range d.counts {
+		if count < minCount {
+			minKey, minCount = k, count
+		}
+	}
+	delete(d.counts, minKey)
+	d.counts[key] = minCount + 1
+}
+
+// IsHot reports whether key has reached Threshold.
+func (d *Detector) IsHot(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.decay()
+	return d.counts[key] >= d.Threshold
+}
+
+// copied records that key was copied to replicas with exptime, so that writes drop the
+// copies even after the key cools down.
+func (d *Detector) copied(key string, exptime int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if exptime < 0 {
+		return
+	}
+	var until time.Time
+	if exptime > 0 {
+		until = d.now().Add(time.Duration(exptime) * time.Second)
+	}
+	if old, ok := d.copies[key]; ok && (old.IsZero() || (!until.IsZero() && old.After(until))) {
+		return
+	}
+	d.copies[key] = until
+}
+
+// hasCopies reports whether replicas may hold a copy of key.
+func (d *Detector) hasCopies(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	until, ok := d.copies[key]
+	if ok && !until.IsZero() && !d.now().Before(until) {
+		delete(d.copies, key)
+		return false
+	}
+	return ok
+}
+
+// Top returns up to n tracked keys, the hottest first.
+func (d *Detector) Top(n int) []KeyCount {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.decay()
+	top := make([]KeyCount, 0, len(d.counts))
+	for key, count := range d.counts {
+		top = append(top, KeyCount{Key: key, Count: count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// HotKeys returns the keys which have reached Threshold, the hottest first.
+func (d *Detector) HotKeys() []KeyCount {
+	top := d.Top(d.capacity)
+	for i, kc := range top {
+		if kc.Count < d.Threshold {
+			return top[:i]
+		}
+	}
+	return top
+}
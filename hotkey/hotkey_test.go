@@ -0,0 +1,147 @@
+package hotkey
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+)
+
+func TestDetector(t *testing.T) {
+	d := NewDetector(3, 1, 10)
+	now := time.Unix(1000, 0)
+	d.now = func() time.Time { return now }
+	d.lastDecay = now
+
+	for i := 0; i < 20; i++ {
+		d.Observe("hot")
+	}
+	for i := 0; i < 12; i++ {
+		d.Observe("warm")
+	}
+	// Each new key replaces the coldest one and inherits its count.
+	for i := 0; i < 5; i++ {
+		d.Observe(fmt.Sprintf("cold%d", i))
+	}
+	assert.Equal(t, []KeyCount{{"hot", 20}, {"warm", 12}, {"cold4", 5}}, d.Top(10))
+
+	assert.True(t, d.IsHot("hot"))
+	assert.True(t, d.IsHot("warm"))
+	assert.False(t, d.IsHot("cold4"))
+	assert.Equal(t, []KeyCount{{"hot", 20}, {"warm", 12}}, d.HotKeys())
+	top := d.Top(1)
+	assert.Equal(t, []KeyCount{{"hot", 20}}, top)
+
+	// Counts decay every Window.
+	now = now.Add(time.Minute)
+	assert.True(t, d.IsHot("hot"))
+	assert.False(t, d.IsHot("warm"))
+	now = now.Add(time.Minute)
+	assert.Empty(t, d.HotKeys())
+}
+
+func TestSampling(t *testing.T) {
+	d := NewDetector(3, 0.5, 1)
+	samples := []float64{0.1, 0.9, 0.4, 0.6}
+	d.random = func() float64 {
+		r := samples[0]
+		samples = samples[1:]
+		return r
+	}
+	for i := 0; i < 4; i++ {
+		d.Observe("foo")
+	}
+	assert.Equal(t, []KeyCount{{"foo", 2}}, d.Top(10))
+}
+
+func TestReplication(t *testing.T) {
+	primary := memdtest.NewFakeConn()
+	replica := memdtest.NewFakeConn()
+	c := NewConn(primary, NewDetector(10, 1, 3), replica)
+	server := 1
+	c.pick = func(n int) int { return server }
+
+	assert.NoError(t, c.Set("foo", []byte("v1"), 42, 0, false))
+	for i := 0; i < 2; i++ {
+		value, _, err := c.Get("foo")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v1"), value)
+	}
+	assert.False(t, c.Detector().IsHot("foo"))
+	_, _, err := replica.Get("foo")
+	assert.Equal(t, memalpha.ErrCacheMiss, err, "not replicated before it is hot")
+
+	// The read making the key hot goes to the replica, which is filled from the primary.
+	value, flags, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1"), value)
+	assert.EqualValues(t, 42, flags)
+	value, _, err = replica.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1"), value)
+
+	// Writes of a hot key update the replicas.
+	assert.NoError(t, c.Set("foo", []byte("v2"), 0, 0, false))
+	value, _, err = replica.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), value)
+
+	assert.NoError(t, c.Append("foo", []byte("+"), false))
+	_, _, err = replica.Get("foo")
+	assert.Equal(t, memalpha.ErrCacheMiss, err, "other writes drop the copies")
+	value, _, err = c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2+"), value)
+
+	server = 0
+	assert.NoError(t, replica.Set("foo", []byte("stale"), 0, 0, false))
+	value, _, err = c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2+"), value, "reads spread to the primary too")
+
+	assert.NoError(t, c.Delete("foo", false))
+	server = 1
+	_, _, err = c.Get("foo")
+	assert.Equal(t, memalpha.ErrCacheMiss, err)
+}
+
+func TestCooledDownReplication(t *testing.T) {
+	primary := memdtest.NewFakeConn()
+	replica := memdtest.NewFakeConn()
+	d := NewDetector(10, 1, 2)
+	now := time.Unix(1000, 0)
+	d.now = func() time.Time { return now }
+	d.lastDecay = now
+	d.Window = time.Second
+	c := NewConn(primary, d, replica)
+	c.pick = func(n int) int { return 1 }
+
+	for _, write := range []func() error{
+		func() error { return c.Set("foo", []byte("v2"), 0, 0, false) },
+		func() error { return c.Delete("foo", false) },
+	} {
+		assert.NoError(t, primary.Set("foo", []byte("v1"), 0, 0, false))
+		for i := 0; i < 2; i++ {
+			_, _, err := c.Get("foo")
+			assert.NoError(t, err)
+		}
+		_, _, err := replica.Get("foo")
+		assert.NoError(t, err, "replicated while hot")
+
+		// Cooled down before the copies expire.
+		now = now.Add(2 * time.Second)
+		assert.False(t, d.IsHot("foo"))
+		assert.NoError(t, write())
+		_, _, err = replica.Get("foo")
+		assert.Equal(t, memalpha.ErrCacheMiss, err, "writes drop the copies of a key which cooled down")
+	}
+
+	// Copies are forgotten once they expire.
+	d.copied("bar", c.ReplicaExptime)
+	assert.True(t, d.hasCopies("bar"))
+	now = now.Add(time.Duration(c.ReplicaExptime) * time.Second)
+	assert.False(t, d.hasCopies("bar"))
+}
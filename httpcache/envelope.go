@@ -0,0 +1,145 @@
+package httpcache
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"sort"
+)
+
+// Envelope types. An envelope is either a stored response or the list of header names a
+// response varies on.
+const (
+	envelopeResponse = 'r'
+	envelopeVary     = 'v'
+)
+
+var errCorruptEnvelope = errors.New("httpcache: corrupt envelope")
+
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// encodeResponse serializes a response as
+//
+//	'r' <status> <number of fields> (<name length> <name> <value length> <value>)* <body>
+//
+// where all numbers are unsigned varints. A header with several values becomes several
+// fields.
+func encodeResponse(r *response) []byte {
+	names := make([]string, 0, len(r.header))
+	fields := 0
+	size := len(r.body) + 2*binary.MaxVarintLen64
+	for name, values := range r.header {
+		names = append(names, name)
+		for _, value := range values {
+			fields++
+			size += 2*binary.MaxVarintLen64 + len(name) + len(value)
+		}
+	}
+	sort.Strings(names)
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, envelopeResponse)
+	buf = binary.AppendUvarint(buf, uint64(r.status))
+	buf = binary.AppendUvarint(buf, uint64(fields))
+	for _, name := range names {
+		for _, value := range r.header[name] {
+			buf = appendString(buf, name)
+			buf = appendString(buf, value)
+		}
+	}
+	return append(buf, r.body...)
+}
+
+// encodeVary serializes header names as 'v' <number of names> (<name length> <name>)*.
+func encodeVary(names []string) []byte {
+	buf := []byte{envelopeVary}
+	buf = binary.AppendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		buf = appendString(buf, name)
+	}
+	return buf
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	n, size := binary.Uvarint(d.data)
+	if size <= 0 {
+		d.err = errCorruptEnvelope
+		return 0
+	}
+	d.data = d.data[size:]
+	return n
+}
+
+func (d *decoder) string() string {
+	length := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if length > uint64(len(d.data)) {
+		d.err = errCorruptEnvelope
+		return ""
+	}
+	s := string(d.data[:length])
+	d.data = d.data[length:]
+	return s
+}
+
+// decodeEnvelope returns either a response or vary header names.
+func decodeEnvelope(data []byte) (*response, []string, error) {
+	if len(data) == 0 {
+		return nil, nil, errCorruptEnvelope
+	}
+	d := &decoder{data: data[1:]}
+
+	switch data[0] {
+	case envelopeResponse:
+		status := d.uvarint()
+		r := &response{status: int(status), header: make(http.Header)}
+		fields := d.uvarint()
+		for i := uint64(0); i < fields && d.err == nil; i++ {
+			name := d.string()
+			r.header[name] = append(r.header[name], d.string())
+		}
+		if d.err != nil {
+			return nil, nil, d.err
+		}
+		if status < 100 || status > 999 {
+			// net/http panics when writing such a status.
+			return nil, nil, errCorruptEnvelope
+		}
+		r.body = d.data
+		return r, nil, nil
+
+	case envelopeVary:
+		count := d.uvarint()
+		if count > uint64(len(d.data)) {
+			return nil, nil, errCorruptEnvelope
+		}
+		names := make([]string, 0, count)
+		for i := uint64(0); i < count && d.err == nil; i++ {
+			names = append(names, d.string())
+		}
+		if d.err != nil {
+			return nil, nil, d.err
+		}
+		return nil, names, nil
+	}
+	return nil, nil, errCorruptEnvelope
+}
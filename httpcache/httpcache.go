@@ -0,0 +1,369 @@
+// Package httpcache provides net/http middleware caching responses in memcached.
+//
+// Only GET and HEAD requests are cached, and only responses which explicitly allow it
+// with a positive Cache-Control max-age (or s-maxage). Responses to requests with an
+// Authorization header are only cached when marked public, s-maxage or must-revalidate,
+// as RFC 9111 section 3.5 requires of shared caches. Responses varying on request
+// headers are stored per combination of the header values. Cached responses carry an
+// ETag, and conditional requests with a matching If-None-Match get a 304.
+//
+// Requests with Cache-Control no-cache are passed to the handler and refresh the cached
+// response, while requests with no-store bypass the cache altogether.
+package httpcache
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+// maxDeltaSeconds is the largest max-age honored, as RFC 9111 section 1.2.2 allows
+// caches to cap it.
+const maxDeltaSeconds = 1 << 31
+
+// DefaultMaxBodySize is the default limit of cached response bodies. It keeps envelopes
+// below the default item size limit of memcached.
+const DefaultMaxBodySize = 1000 * 1024
+
+// Cache is a memcached backed HTTP response cache.
+type Cache struct {
+	pool *memalpha.Pool
+
+	// Prefix is prepended to the keys of cached responses.
+	Prefix string
+
+	// MaxBodySize is the largest response body which is cached.
+	MaxBodySize int
+}
+
+// New creates a Cache storing responses through connections of pool.
+func New(pool *memalpha.Pool) *Cache {
+	return &Cache{
+		pool:        pool,
+		Prefix:      "httpcache:",
+		MaxBodySize: DefaultMaxBodySize,
+	}
+}
+
+// key hashes parts into a key. Hashing keeps keys short and free of characters memcached
+// does not accept.
+func (c *Cache) key(parts ...string) string {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return c.Prefix + hex.EncodeToString(h.Sum(nil))
+}
+
+// keyMethod returns the method r is cached under. HEAD requests are served from the
+// responses to GET.
+func keyMethod(r *http.Request) string {
+	if r.Method == http.MethodHead {
+		return http.MethodGet
+	}
+	return r.Method
+}
+
+func (c *Cache) baseKey(r *http.Request) string {
+	return c.key(keyMethod(r), r.Host, r.URL.String())
+}
+
+func (c *Cache) variantKey(r *http.Request, vary []string) string {
+	parts := []string{keyMethod(r), r.Host, r.URL.String()}
+	for _, name := range vary {
+		parts = append(parts, name, strings.Join(r.Header[name], ","))
+	}
+	return c.key(parts...)
+}
+
+// cacheControl parses the directives of the Cache-Control headers.
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, line := range header["Cache-Control"] {
+		for _, directive := range strings.Split(line, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, value := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, value = directive[:i], strings.Trim(directive[i+1:], `"`)
+			}
+			directives[strings.ToLower(name)] = value
+		}
+	}
+	return directives
+}
+
+// maxAge returns how long a response may be cached, or 0 if it must not be. A response
+// to a request with authorization must also be marked as shareable.
+func maxAge(header http.Header, authorized bool) time.Duration {
+	cc := cacheControl(header)
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[directive]; ok {
+			return 0
+		}
+	}
+	if authorized && !shareable(cc) {
+		return 0
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := cc[directive]; ok {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds < 0 {
+				return 0
+			}
+			if seconds > maxDeltaSeconds {
+				seconds = maxDeltaSeconds
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 0
+}
+
+// shareable reports whether the directives allow a shared cache to store the response to
+// a request with authorization.
+func shareable(cc map[string]string) bool {
+	for _, directive := range []string{"public", "s-maxage", "must-revalidate"} {
+		if _, ok := cc[directive]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// varyNames returns the canonical names of the Vary headers, and false if the response
+// varies on something else than request headers.
+func varyNames(header http.Header) ([]string, bool) {
+	var names []string
+	for _, line := range header["Vary"] {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				names = append(names, textproto.CanonicalMIMEHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware returns a handler serving cached responses and caching the responses of
+// next. When memcached fails, requests are passed to next uncached.
+func (c *Cache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || hasDirective(r.Header, "no-store") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		conn, err := c.pool.GetContext(r.Context())
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var cached *response
+		if !hasDirective(r.Header, "no-cache") {
+			cached, err = c.lookup(conn, r)
+		}
+		if err != nil && err != memalpha.ErrCacheMiss {
+			_ = conn.Close()
+			next.ServeHTTP(w, r)
+			return
+		}
+		_ = c.pool.Put(conn)
+
+		if cached != nil {
+			serveCached(w, r, cached)
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w, limit: c.MaxBodySize}
+		next.ServeHTTP(rec, r)
+		c.store(r, rec)
+	})
+}
+
+func hasDirective(header http.Header, directive string) bool {
+	_, ok := cacheControl(header)[directive]
+	return ok
+}
+
+// lookup returns the cached response for r. It returns memalpha.ErrCacheMiss if there is
+// none.
+func (c *Cache) lookup(conn memalpha.Conn, r *http.Request) (*response, error) {
+	key := c.baseKey(r)
+	for i := 0; i < 2; i++ {
+		data, _, err := conn.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		cached, vary, err := decodeEnvelope(data)
+		if err != nil {
+			return nil, memalpha.ErrCacheMiss
+		}
+		if cached != nil {
+			return cached, nil
+		}
+		key = c.variantKey(r, vary)
+	}
+	return nil, memalpha.ErrCacheMiss
+}
+
+func serveCached(w http.ResponseWriter, r *http.Request, cached *response) {
+	header := w.Header()
+	for name, values := range cached.header {
+		header[name] = values
+	}
+	header.Set("X-Cache", "HIT")
+
+	if etagMatches(r.Header.Get("If-None-Match"), cached.header.Get("Etag")) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(cached.status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(cached.body)
+	}
+}
+
+// cacheableStatus lists the status codes which are cached.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+func (c *Cache) store(r *http.Request, rec *recorder) {
+	if rec.overflow || r.Method != http.MethodGet || !cacheableStatus[rec.status()] {
+		return
+	}
+	header := rec.snapshot
+	if header == nil {
+		header = rec.ResponseWriter.Header().Clone()
+	}
+	if header.Get("Set-Cookie") != "" {
+		return
+	}
+	ttl := maxAge(header, r.Header.Get("Authorization") != "")
+	if ttl <= 0 {
+		return
+	}
+	exptime := memalpha.Exptime(ttl)
+	vary, ok := varyNames(header)
+	if !ok {
+		return
+	}
+
+	stored := &response{status: rec.status(), header: header, body: rec.body.Bytes()}
+	if stored.header.Get("Etag") == "" {
+		sum := sha1.Sum(stored.body)
+		stored.header.Set("Etag", `"`+hex.EncodeToString(sum[:8])+`"`)
+	}
+	stored.header.Del("X-Cache")
+
+	conn, err := c.pool.GetContext(r.Context())
+	if err != nil {
+		return
+	}
+	key := c.baseKey(r)
+	if len(vary) > 0 {
+		if err = conn.Set(key, encodeVary(vary), 0, exptime, false); err != nil {
+			_ = conn.Close()
+			return
+		}
+		key = c.variantKey(r, vary)
+	}
+	if err = conn.Set(key, encodeResponse(stored), 0, exptime, false); err != nil {
+		_ = conn.Close()
+		return
+	}
+	_ = c.pool.Put(conn)
+}
+
+// recorder passes a response through while keeping a copy of it. Flushes are passed on
+// to the wrapped ResponseWriter when it is an http.Flusher.
+type recorder struct {
+	http.ResponseWriter
+	limit       int
+	code        int
+	snapshot    http.Header
+	body        bytes.Buffer
+	overflow    bool
+	wroteHeader bool
+}
+
+func (rec *recorder) WriteHeader(code int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.wroteHeader = true
+	rec.code = code
+	rec.snapshot = rec.ResponseWriter.Header().Clone()
+	rec.ResponseWriter.Header().Set("X-Cache", "MISS")
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *recorder) Write(p []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflow {
+		if rec.body.Len()+len(p) > rec.limit {
+			rec.overflow = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+// Flush sends any buffered data to the client.
+func (rec *recorder) Flush() {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *recorder) status() int {
+	if !rec.wroteHeader {
+		return http.StatusOK
+	}
+	return rec.code
+}
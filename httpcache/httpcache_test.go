@@ -0,0 +1,231 @@
+package httpcache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+)
+
+func newCache() *Cache {
+	conn := memdtest.NewFakeConn()
+	return New(memalpha.NewPool(func(context.Context) (memalpha.Conn, error) {
+		return conn, nil
+	}, 1))
+}
+
+func serve(h http.Handler, method string, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestMiddleware(t *testing.T) {
+	calls := 0
+	h := newCache().Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "response %d", calls)
+	}))
+
+	w := serve(h, "GET", "/foo", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "response 1", w.Body.String())
+	assert.Equal(t, "MISS", w.Header().Get("X-Cache"))
+
+	w = serve(h, "GET", "/foo", nil)
+	assert.Equal(t, "response 1", w.Body.String(), "served from cache")
+	assert.Equal(t, "HIT", w.Header().Get("X-Cache"))
+	assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+	etag := w.Header().Get("Etag")
+	assert.NotEmpty(t, etag, "an ETag is generated")
+
+	w = serve(h, "HEAD", "/foo", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Body.String(), "HEAD is served from GET without a body")
+
+	w = serve(h, "GET", "/foo", http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	w = serve(h, "GET", "/foo?bar", nil)
+	assert.Equal(t, "response 2", w.Body.String(), "the query is part of the key")
+
+	w = serve(h, "GET", "http://other.example/foo", nil)
+	assert.Equal(t, "response 3", w.Body.String(), "the host is part of the key")
+
+	w = serve(h, "GET", "/foo", http.Header{"Cache-Control": {"no-store"}})
+	assert.Equal(t, "response 4", w.Body.String(), "request no-store bypasses the cache")
+
+	w = serve(h, "GET", "/foo", http.Header{"Cache-Control": {"no-cache"}})
+	assert.Equal(t, "response 5", w.Body.String(), "request no-cache is not served from the cache")
+	w = serve(h, "GET", "/foo", nil)
+	assert.Equal(t, "response 5", w.Body.String(), "request no-cache refreshes the cache")
+
+	w = serve(h, "POST", "/foo", nil)
+	assert.Equal(t, "response 6", w.Body.String(), "POST is not cached")
+}
+
+func TestCorruptEntry(t *testing.T) {
+	backend := memdtest.NewFakeConn()
+	c := New(memalpha.NewPool(func(context.Context) (memalpha.Conn, error) {
+		return backend, nil
+	}, 1))
+	h := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "fresh")
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	bad := encodeResponse(&response{status: 42, header: http.Header{}, body: []byte("stale")})
+	assert.NoError(t, backend.Set(c.baseKey(r), bad, 0, 0, false))
+	w := serve(h, "GET", "/", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "fresh", w.Body.String(), "a corrupt entry is a miss")
+}
+
+func TestFlush(t *testing.T) {
+	h := newCache().Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "partial")
+		f, ok := w.(http.Flusher)
+		assert.True(t, ok, "the recorder is an http.Flusher")
+		if ok {
+			f.Flush()
+		}
+	}))
+	w := serve(h, "GET", "/", nil)
+	assert.True(t, w.Flushed)
+	assert.Equal(t, "partial", serve(h, "GET", "/", nil).Body.String(), "flushed responses are cached")
+}
+
+func TestUncacheable(t *testing.T) {
+	for _, header := range []http.Header{
+		{},
+		{"Cache-Control": {"no-store, max-age=60"}},
+		{"Cache-Control": {"private, max-age=60"}},
+		{"Cache-Control": {"max-age=0"}},
+		{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}},
+		{"Cache-Control": {"max-age=60"}, "Vary": {"*"}},
+	} {
+		calls := 0
+		h := newCache().Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			fmt.Fprint(w, "body")
+		}))
+		serve(h, "GET", "/", nil)
+		serve(h, "GET", "/", nil)
+		assert.Equal(t, 2, calls, "%v", header)
+	}
+
+	calls := 0
+	h := newCache().Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	serve(h, "GET", "/", nil)
+	serve(h, "GET", "/", nil)
+	assert.Equal(t, 2, calls, "errors are not cached")
+}
+
+func TestAuthorization(t *testing.T) {
+	for _, tt := range []struct {
+		cacheControl string
+		cached       bool
+	}{
+		{"max-age=60", false},
+		{"public, max-age=60", true},
+		{"s-maxage=60", true},
+		{"must-revalidate, max-age=60", true},
+	} {
+		calls := 0
+		h := newCache().Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Header().Set("Cache-Control", tt.cacheControl)
+			fmt.Fprint(w, "body")
+		}))
+		authorization := http.Header{"Authorization": {"Bearer token"}}
+		serve(h, "GET", "/", authorization)
+		serve(h, "GET", "/", authorization)
+		if tt.cached {
+			assert.Equal(t, 1, calls, tt.cacheControl)
+		} else {
+			assert.Equal(t, 2, calls, tt.cacheControl)
+		}
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	assert.Equal(t, time.Minute, maxAge(http.Header{"Cache-Control": {"max-age=60"}}, false))
+	assert.Equal(t, time.Duration(maxDeltaSeconds)*time.Second,
+		maxAge(http.Header{"Cache-Control": {"max-age=99999999999999"}}, false))
+	assert.Zero(t, maxAge(http.Header{"Cache-Control": {"max-age=-1"}}, false))
+}
+
+func TestVary(t *testing.T) {
+	calls := 0
+	h := newCache().Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "accept-language")
+		fmt.Fprintf(w, "%s %d", r.Header.Get("Accept-Language"), calls)
+	}))
+
+	ja := http.Header{"Accept-Language": {"ja"}}
+	en := http.Header{"Accept-Language": {"en"}}
+
+	assert.Equal(t, "ja 1", serve(h, "GET", "/", ja).Body.String())
+	assert.Equal(t, "en 2", serve(h, "GET", "/", en).Body.String())
+	assert.Equal(t, "ja 1", serve(h, "GET", "/", ja).Body.String())
+	assert.Equal(t, "en 2", serve(h, "GET", "/", en).Body.String())
+}
+
+func TestMaxBodySize(t *testing.T) {
+	c := newCache()
+	c.MaxBodySize = 4
+	calls := 0
+	h := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "large body")
+	}))
+	assert.Equal(t, "large body", serve(h, "GET", "/", nil).Body.String())
+	assert.Equal(t, "large body", serve(h, "GET", "/", nil).Body.String())
+	assert.Equal(t, 2, calls)
+}
+
+func TestEnvelope(t *testing.T) {
+	r := &response{
+		status: http.StatusNotFound,
+		header: http.Header{"Set-Multi": {"a", "b"}, "Etag": {`"x"`}},
+		body:   []byte("body"),
+	}
+	decoded, vary, err := decodeEnvelope(encodeResponse(r))
+	assert.NoError(t, err)
+	assert.Nil(t, vary)
+	assert.Equal(t, r, decoded)
+
+	decoded, vary, err = decodeEnvelope(encodeVary([]string{"Accept", "Accept-Language"}))
+	assert.NoError(t, err)
+	assert.Nil(t, decoded)
+	assert.Equal(t, []string{"Accept", "Accept-Language"}, vary)
+
+	for _, corrupt := range [][]byte{nil, []byte("x"), []byte("r"), []byte("r\xc8\x01\x01\x05ab"), []byte("r\x00\x00"), []byte("r\xe8\x07\x00"), []byte("v\x05")} {
+		_, _, err = decodeEnvelope(corrupt)
+		assert.Equal(t, errCorruptEnvelope, err, "decode(%q)", corrupt)
+	}
+}
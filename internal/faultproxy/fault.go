@@ -0,0 +1,94 @@
+package faultproxy
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+// Fault decides what the client receives in place of the response to a command. It
+// returns the bytes to send and whether the connection is closed after them.
+//
+// Responses of retrieval commands are complete, with all their VALUE blocks and the
+// trailing END. Faults of noreply commands receive an empty response.
+type Fault func(response []byte) (out []byte, closeConn bool)
+
+// Delay forwards the response after d.
+func Delay(d time.Duration) Fault {
+	return func(response []byte) ([]byte, bool) {
+		time.Sleep(d)
+		return response, false
+	}
+}
+
+// DropAfter forwards the first n bytes of the response, then closes the connection.
+func DropAfter(n int) Fault {
+	return func(response []byte) ([]byte, bool) {
+		if n < len(response) {
+			response = response[:n]
+		}
+		return response, true
+	}
+}
+
+// TruncateValue forwards the response up to the middle of the first value, then closes
+// the connection. Responses without a value are forwarded as is.
+func TruncateValue() Fault {
+	return func(response []byte) ([]byte, bool) {
+		blocks := dataBlocks(response)
+		if len(blocks) == 0 {
+			return response, false
+		}
+		b := blocks[0]
+		return response[:b.start+b.size/2], true
+	}
+}
+
+// CorruptCRLF replaces the "\r\n" following every value with other bytes, so that the
+// client reads the value but not its terminator. Responses without a value are forwarded
+// as is.
+func CorruptCRLF() Fault {
+	return func(response []byte) ([]byte, bool) {
+		out := append([]byte(nil), response...)
+		for _, b := range dataBlocks(out) {
+			copy(out[b.start+b.size:], "XX")
+		}
+		return out, false
+	}
+}
+
+// ServerError replaces the response with "SERVER_ERROR msg". The command has still been
+// executed by the server.
+func ServerError(msg string) Fault {
+	return func(response []byte) ([]byte, bool) {
+		return []byte("SERVER_ERROR " + msg + "\r\n"), false
+	}
+}
+
+type dataBlock struct {
+	start int
+	size  int
+}
+
+// dataBlocks locates the values in a retrieval response.
+func dataBlocks(response []byte) []dataBlock {
+	var blocks []dataBlock
+	pos := 0
+	for {
+		i := bytes.Index(response[pos:], crlf)
+		if i < 0 {
+			return blocks
+		}
+		fields := bytes.Fields(response[pos : pos+i])
+		pos += i + len(crlf)
+		if len(fields) < 4 || !bytes.Equal(fields[0], []byte("VALUE")) {
+			return blocks
+		}
+		size, err := strconv.Atoi(string(fields[3]))
+		if err != nil || pos+size+len(crlf) > len(response) {
+			return blocks
+		}
+		blocks = append(blocks, dataBlock{start: pos, size: size})
+		pos += size + len(crlf)
+	}
+}
@@ -0,0 +1,286 @@
+// Package faultproxy is a TCP proxy between memcached clients and a server which injects
+// faults into the responses, for testing how code behaves when memcached is slow or
+// broken.
+//
+// The proxy understands the text protocol well enough to find the boundaries of commands
+// and responses. Faults are scripted per command name:
+//
+//	p, _ := faultproxy.New(memd.Addr)
+//	p.Script("get", nil, faultproxy.DropAfter(5)) // the second get is dropped
+//	p.Always("set", faultproxy.Delay(time.Second))
+//	conn, _ := textproto.Dial(p.Addr)
+package faultproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// AnyCommand matches the commands without a fault of their own in Script and Always.
+const AnyCommand = ""
+
+var crlf = []byte("\r\n")
+
+// Proxy forwards connections to a memcached server, injecting faults.
+type Proxy struct {
+	// Addr is the address clients connect to.
+	Addr string
+
+	target   string
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	scripts map[string][]Fault
+	always  map[string]Fault
+	conns   map[net.Conn]struct{}
+	closed  bool
+}
+
+// New starts a Proxy on a free port of localhost forwarding to target.
+func New(target string) (*Proxy, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		Addr:     l.Addr().String(),
+		target:   target,
+		listener: l,
+		scripts:  make(map[string][]Fault),
+		always:   make(map[string]Fault),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	p.wg.Add(1)
+	go p.serve()
+	return p, nil
+}
+
+// Script queues faults for the next commands named command, one fault per command. A nil
+// fault lets the response through unchanged. Queued faults take precedence over Always.
+func (p *Proxy) Script(command string, faults ...Fault) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.scripts[command] = append(p.scripts[command], faults...)
+}
+
+// Always injects fault into every command named command once its script is exhausted.
+// A nil fault removes it.
+func (p *Proxy) Always(command string, fault Fault) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if fault == nil {
+		delete(p.always, command)
+		return
+	}
+	p.always[command] = fault
+}
+
+// Reset removes all scripted faults.
+func (p *Proxy) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.scripts = make(map[string][]Fault)
+	p.always = make(map[string]Fault)
+}
+
+// next returns the fault for a command, or nil.
+func (p *Proxy) next(command string) Fault {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, name := range []string{command, AnyCommand} {
+		if script := p.scripts[name]; len(script) > 0 {
+			p.scripts[name] = script[1:]
+			return script[0]
+		}
+		if fault, ok := p.always[name]; ok {
+			return fault
+		}
+	}
+	return nil
+}
+
+// Close stops the proxy and closes all connections.
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.mu.Unlock()
+
+	err := p.listener.Close()
+	p.wg.Wait()
+	return err
+}
+
+// track registers conn to be closed by Close. It returns false if the proxy is closed.
+func (p *Proxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		_ = conn.Close()
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *Proxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.conns, conn)
+	_ = conn.Close()
+}
+
+func (p *Proxy) serve() {
+	defer p.wg.Done()
+
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		if !p.track(client) {
+			return
+		}
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer p.untrack(client)
+
+			server, err := net.Dial("tcp", p.target)
+			if err != nil || !p.track(server) {
+				return
+			}
+			defer p.untrack(server)
+
+			p.relay(client, server)
+		}()
+	}
+}
+
+// relay forwards the commands of client to server one at a time, and their responses
+// back through the faults.
+func (p *Proxy) relay(client net.Conn, server net.Conn) {
+	cr := bufio.NewReader(client)
+	sr := bufio.NewReader(server)
+	for {
+		command, err := readCommand(cr)
+		if err != nil {
+			return
+		}
+		if _, err := server.Write(command); err != nil {
+			return
+		}
+
+		fields := bytes.Fields(command[:bytes.IndexByte(command, '\n')])
+		if len(fields) == 0 {
+			fields = [][]byte{nil}
+		}
+		name := string(fields[0])
+		if name == "quit" {
+			return
+		}
+
+		var response []byte
+		if !bytes.Equal(fields[len(fields)-1], []byte("noreply")) {
+			if response, err = readResponse(sr, name); err != nil {
+				return
+			}
+		}
+
+		closeConn := false
+		if fault := p.next(name); fault != nil {
+			response, closeConn = fault(response)
+		}
+		if _, err := client.Write(response); err != nil || closeConn {
+			return
+		}
+	}
+}
+
+// readCommand reads a command line and, for storage commands, its data block.
+func readCommand(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	fields := bytes.Fields(line)
+	if len(fields) < 5 {
+		return line, nil
+	}
+	switch string(fields[0]) {
+	case "set", "add", "replace", "append", "prepend", "cas":
+	default:
+		return line, nil
+	}
+	size, err := strconv.Atoi(string(fields[4]))
+	if err != nil || size < 0 {
+		return line, nil
+	}
+
+	command := make([]byte, len(line)+size+len(crlf))
+	copy(command, line)
+	if _, err := io.ReadFull(r, command[len(line):]); err != nil {
+		return nil, err
+	}
+	return command, nil
+}
+
+// readResponse reads the complete response to the command name.
+func readResponse(r *bufio.Reader, name string) ([]byte, error) {
+	multiline := false
+	switch name {
+	case "get", "gets", "gat", "gats", "stats":
+		multiline = true
+	}
+
+	var response []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		response = append(response, line...)
+		if !multiline || isEnd(line) {
+			return response, nil
+		}
+
+		// VALUE <key> <flags> <bytes> [<cas unique>]
+		fields := bytes.Fields(line)
+		if len(fields) >= 4 && bytes.Equal(fields[0], []byte("VALUE")) {
+			size, err := strconv.Atoi(string(fields[3]))
+			if err != nil || size < 0 {
+				return response, nil
+			}
+			data := make([]byte, size+len(crlf))
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+			response = append(response, data...)
+		}
+	}
+}
+
+// isEnd reports whether line ends a multi-line response.
+func isEnd(line []byte) bool {
+	line = bytes.TrimRight(line, "\r\n")
+	return bytes.Equal(line, []byte("END")) ||
+		bytes.Equal(line, []byte("ERROR")) ||
+		bytes.HasPrefix(line, []byte("CLIENT_ERROR ")) ||
+		bytes.HasPrefix(line, []byte("SERVER_ERROR "))
+}
@@ -0,0 +1,112 @@
+package faultproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+	"github.com/ttakezawa/memalpha/textproto"
+)
+
+func startProxy(t *testing.T) (*Proxy, *textproto.TextConn, func()) {
+	memd := memdtest.NewMemd()
+	if err := memd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(memd.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial(p.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, c, func() {
+		_ = c.Close()
+		_ = p.Close()
+		_ = memd.Close()
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	_, c, done := startProxy(t)
+	defer done()
+
+	assert.NoError(t, c.Set("foo", []byte("bar"), 42, 0, false))
+	assert.NoError(t, c.Set("baz", []byte("qux"), 0, 0, true))
+	m, err := c.Gets([]string{"foo", "baz", "missing"})
+	assert.NoError(t, err)
+	assert.Len(t, m, 2)
+	assert.Equal(t, []byte("bar"), m["foo"].Value)
+	assert.EqualValues(t, 42, m["foo"].Flags)
+
+	stats, err := c.Stats("")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, stats)
+}
+
+func TestScript(t *testing.T) {
+	p, c, done := startProxy(t)
+	defer done()
+
+	p.Script("set", nil, ServerError("out of memory"))
+	assert.NoError(t, c.Set("foo", []byte("bar"), 0, 0, false))
+	assert.Equal(t, memalpha.ServerError("out of memory"), c.Set("foo", []byte("bar"), 0, 0, false))
+	assert.NoError(t, c.Set("foo", []byte("bar"), 0, 0, false), "the script is exhausted")
+
+	p.Always(AnyCommand, Delay(50*time.Millisecond))
+	start := time.Now()
+	_, _, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	p.Reset()
+	start = time.Now()
+	_, _, err = c.Get("foo")
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+}
+
+func TestBrokenResponses(t *testing.T) {
+	p, c, done := startProxy(t)
+	defer done()
+	assert.NoError(t, c.Set("foo", []byte("0123456789"), 0, 0, false))
+
+	p.Script("get", CorruptCRLF())
+	_, _, err := c.Get("foo")
+	assert.Equal(t, memalpha.ProtocolError("malformed response: corrupt get result end"), err)
+	_ = c.Close()
+
+	for _, fault := range []Fault{DropAfter(5), TruncateValue()} {
+		c, err = textproto.Dial(p.Addr)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		p.Script("get", fault)
+		_, _, err = c.Get("foo")
+		assert.Error(t, err)
+		_ = c.Close()
+	}
+}
+
+func TestFaults(t *testing.T) {
+	response := []byte("VALUE a 0 3\r\nabc\r\nVALUE b 0 2\r\nde\r\nEND\r\n")
+
+	out, closeConn := DropAfter(4)(response)
+	assert.Equal(t, []byte("VALU"), out)
+	assert.True(t, closeConn)
+
+	out, closeConn = TruncateValue()(response)
+	assert.Equal(t, []byte("VALUE a 0 3\r\na"), out)
+	assert.True(t, closeConn)
+
+	out, closeConn = CorruptCRLF()(response)
+	assert.Equal(t, []byte("VALUE a 0 3\r\nabcXXVALUE b 0 2\r\ndeXXEND\r\n"), out)
+	assert.False(t, closeConn)
+
+	out, closeConn = TruncateValue()([]byte("STORED\r\n"))
+	assert.Equal(t, []byte("STORED\r\n"), out)
+	assert.False(t, closeConn)
+}
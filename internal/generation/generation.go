@@ -0,0 +1,52 @@
+// Package generation manages generation counters stored in memcached. A generation is
+// bumped to invalidate everything derived from it, as namespace and tagging do.
+package generation
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+// maxCreateAttempts bounds the attempts of Create to add a counter which keeps
+// disappearing before it can be read.
+const maxCreateAttempts = 3
+
+// ErrUnstable means a generation counter could be neither created nor read, because it
+// kept disappearing, for example under heavy eviction or racing deletes.
+var ErrUnstable = errors.New("memcache: generation counter keeps disappearing")
+
+// Parse decodes the value of a generation counter.
+func Parse(data []byte) (uint64, error) {
+	return strconv.ParseUint(string(data), 10, 64)
+}
+
+// Create initializes the generation counter at key, which was found missing, and returns
+// its value. If another client creates it first, its value is returned instead.
+func Create(conn memalpha.Conn, key string, now time.Time) (uint64, error) {
+	for i := 0; i < maxCreateAttempts; i++ {
+		// Start from the current time rather than 0, so that whatever was derived from an
+		// evicted generation counter cannot come back to life.
+		value := uint64(now.UnixNano())
+		err := conn.Add(key, strconv.AppendUint(nil, value, 10), 0, 0, false)
+		if err == nil {
+			return value, nil
+		}
+		if err != memalpha.ErrNotStored {
+			return 0, err
+		}
+
+		// Another client created it first.
+		data, _, err := conn.Get(key)
+		if err == memalpha.ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return Parse(data)
+	}
+	return 0, ErrUnstable
+}
@@ -0,0 +1,49 @@
+package generation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+)
+
+func TestCreate(t *testing.T) {
+	conn := memdtest.NewFakeConn()
+	now := time.Unix(1000, 0)
+
+	value, err := Create(conn, "gen", now)
+	assert.NoError(t, err)
+	assert.EqualValues(t, now.UnixNano(), value, "a generation starts from the current time")
+
+	// An existing counter is returned as is.
+	other, err := Create(conn, "gen", now.Add(time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, value, other)
+
+	_, err = conn.Increment("gen", 1, false)
+	assert.NoError(t, err)
+	bumped, err := Create(conn, "gen", now)
+	assert.NoError(t, err)
+	assert.Equal(t, value+1, bumped)
+}
+
+// vanishingConn never stores anything, but reports every key as already present.
+type vanishingConn struct {
+	memalpha.Conn
+}
+
+func (vanishingConn) Add(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	return memalpha.ErrNotStored
+}
+
+func (vanishingConn) Get(key string) ([]byte, uint32, error) {
+	return nil, 0, memalpha.ErrCacheMiss
+}
+
+func TestCreateUnstable(t *testing.T) {
+	_, err := Create(vanishingConn{}, "gen", time.Unix(1000, 0))
+	assert.Equal(t, ErrUnstable, err)
+}
@@ -0,0 +1,14 @@
+package memdtest
+
+import (
+	memserver "github.com/ttakezawa/memalpha/server"
+)
+
+// FakeConn is an in-memory memalpha.Conn for unit tests. It mimics the replies of a
+// memcached server without any network I/O and is safe for concurrent use.
+type FakeConn = memserver.Cache
+
+// NewFakeConn creates an empty FakeConn without a size limit.
+func NewFakeConn() *FakeConn {
+	return memserver.NewCache(0)
+}
@@ -0,0 +1,50 @@
+package memdtest
+
+import (
+	"net"
+
+	memserver "github.com/ttakezawa/memalpha/server"
+)
+
+// Memd is an in-process memcached server speaking the text protocol. Items are kept in a
+// FakeConn, so expirations follow Store.Now, which tests may replace with Clock.Now
+// before Start.
+type Memd struct {
+	// Store holds the items.
+	Store *FakeConn
+
+	// MaxItemSize is the largest value accepted by storage commands.
+	MaxItemSize int
+
+	// Addr is the address the server listens on, set by Start.
+	Addr string
+
+	srv *memserver.Server
+}
+
+// NewMemd creates a Memd with an empty store.
+func NewMemd() *Memd {
+	return &Memd{
+		Store:       NewFakeConn(),
+		MaxItemSize: memserver.DefaultMaxItemSize,
+	}
+}
+
+// Start listens on a free port of localhost and serves connections in the background.
+func (m *Memd) Start() error {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return err
+	}
+	m.Addr = l.Addr().String()
+
+	m.srv = memserver.New(m.Store)
+	m.srv.MaxItemSize = m.MaxItemSize
+	go func() { _ = m.srv.Serve(l) }()
+	return nil
+}
+
+// Close stops listening and closes all connections.
+func (m *Memd) Close() error {
+	return m.srv.Close()
+}
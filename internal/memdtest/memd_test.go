@@ -0,0 +1,93 @@
+package memdtest
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+type rawClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialRaw(t *testing.T, addr string) *rawClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &rawClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends request and checks that the following replies are expected.
+func (c *rawClient) do(request string, expected ...string) {
+	if _, err := c.conn.Write([]byte(request)); err != nil {
+		c.t.Fatal(err)
+	}
+	for _, line := range expected {
+		reply, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("request %q: %s", request, err)
+		}
+		assert.Equal(c.t, line+"\r\n", reply, "request %q", request)
+	}
+}
+
+func TestClock(t *testing.T) {
+	clock := NewClock(time.Unix(1000, 0))
+	assert.Equal(t, time.Unix(1000, 0), clock.Now())
+	clock.Advance(time.Minute)
+	assert.Equal(t, time.Unix(1060, 0), clock.Now())
+}
+
+func TestMemd(t *testing.T) {
+	memd := NewMemd()
+	clock := NewClock(time.Unix(1000, 0))
+	memd.Store.Now = clock.Now
+	memd.MaxItemSize = 4
+	if !assert.NoError(t, memd.Start()) {
+		return
+	}
+	defer func() { _ = memd.Close() }()
+	c := dialRaw(t, memd.Addr)
+
+	c.do("set foo 42 10 3\r\nbar\r\n", "STORED")
+	c.do("get foo\r\n", "VALUE foo 42 3", "bar", "END")
+	c.do("set foo 0 0 5\r\n12345\r\n", "SERVER_ERROR object too large for cache")
+
+	// The items are kept in Store, and expire by its clock.
+	value, flags, err := memd.Store.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), value)
+	assert.EqualValues(t, 42, flags)
+	clock.Advance(10 * time.Second)
+	c.do("get foo\r\n", "END")
+
+	assert.NoError(t, memd.Close())
+	_, err = c.r.ReadString('\n')
+	assert.Error(t, err, "connections are closed")
+}
+
+func TestNewServer(t *testing.T) {
+	var dialed []string
+	s := NewServer(func(addr string) (memalpha.Conn, error) {
+		dialed = append(dialed, addr)
+		return NewFakeConn(), nil
+	})
+	if !assert.NoError(t, s.Start()) {
+		return
+	}
+	defer func() { _ = s.Shutdown() }()
+
+	assert.Equal(t, []string{s.Addr}, dialed)
+	assert.NotNil(t, s.Conn)
+	c := dialRaw(t, s.Addr)
+	c.do("set foo 0 0 3\r\nbar\r\n", "STORED")
+	c.do("get foo\r\n", "VALUE foo 0 3", "bar", "END")
+}
@@ -23,15 +23,22 @@ func freePort() (int, error) {
 type server struct {
 	Dial func(addr string) (memalpha.Conn, error)
 	cmd  *exec.Cmd
+	memd *Memd
 	Addr string
 	Conn memalpha.Conn
 }
 
+// NewServer creates a test server. Start runs a memcached binary if one is installed,
+// and falls back to an in-process Memd otherwise.
 func NewServer(dial func(addr string) (memalpha.Conn, error)) *server {
 	return &server{Dial: dial}
 }
 
 func (s *server) Start() error {
+	if _, err := exec.LookPath("memcached"); err != nil {
+		return s.startMemd()
+	}
+
 	port, err := freePort()
 	if err != nil {
 		return err
@@ -56,7 +63,26 @@ func (s *server) Start() error {
 	return err
 }
 
+func (s *server) startMemd() error {
+	s.memd = NewMemd()
+	if err := s.memd.Start(); err != nil {
+		return err
+	}
+
+	conn, err := s.Dial(s.memd.Addr)
+	if err != nil {
+		_ = s.memd.Close()
+		return err
+	}
+	s.Addr = s.memd.Addr
+	s.Conn = conn
+	return nil
+}
+
 func (s *server) Shutdown() error {
+	if s.memd != nil {
+		return s.memd.Close()
+	}
 	_ = s.cmd.Process.Kill()
 	return s.cmd.Wait()
 }
@@ -0,0 +1,84 @@
+package transcript
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+)
+
+// MismatchError means the client diverged from the transcript.
+type MismatchError struct {
+	// Turn is the index of the turn in the transcript.
+	Turn     int
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("transcript: turn %d: client sent %q, want %q", e.Turn, e.Actual, e.Expected)
+}
+
+// Replayer plays the server side of a transcript, checking that the client sends the
+// same bytes as recorded.
+type Replayer struct {
+	transcript Transcript
+	done       chan struct{}
+	err        error
+}
+
+// NewReplayer creates a Replayer of t.
+func NewReplayer(t Transcript) *Replayer {
+	return &Replayer{transcript: t}
+}
+
+// Serve replays the transcript over conn, the server side of a connection. After the
+// transcript, it waits for the client to close the connection. It returns a
+// *MismatchError if the client diverges from the transcript.
+func (r *Replayer) Serve(conn net.Conn) error {
+	defer func() { _ = conn.Close() }()
+
+	for i, turn := range r.transcript {
+		if !turn.FromClient {
+			if _, err := conn.Write(turn.Data); err != nil {
+				return fmt.Errorf("transcript: turn %d: %s", i, err)
+			}
+			continue
+		}
+
+		// Check each read, so that a diverging client fails at once rather than waiting
+		// for a reply.
+		actual := make([]byte, len(turn.Data))
+		for n := 0; n < len(actual); {
+			m, err := conn.Read(actual[n:])
+			n += m
+			if !bytes.Equal(actual[:n], turn.Data[:n]) || (err != nil && n < len(actual)) {
+				return &MismatchError{Turn: i, Expected: turn.Data, Actual: actual[:n]}
+			}
+		}
+	}
+
+	extra, _ := io.ReadAll(conn)
+	if len(extra) > 0 {
+		return &MismatchError{Turn: len(r.transcript), Actual: extra}
+	}
+	return nil
+}
+
+// Conn returns the client side of an in-memory connection served by r.
+func (r *Replayer) Conn() net.Conn {
+	client, server := net.Pipe()
+	r.done = make(chan struct{})
+	go func() {
+		defer close(r.done)
+		r.err = r.Serve(server)
+	}()
+	return client
+}
+
+// Wait waits for the connection returned by Conn to be served and returns the result of
+// Serve. Close the client connection first.
+func (r *Replayer) Wait() error {
+	<-r.done
+	return r.err
+}
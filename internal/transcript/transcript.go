@@ -0,0 +1,158 @@
+// Package transcript records the traffic of memcached connections and replays it in
+// tests.
+//
+// A transcript is a sequence of chunks. Each chunk is a header line, the raw bytes it
+// announces and a newline:
+//
+//	> 20
+//	set foo 0 0 3
+//	bar
+//
+//	< 8
+//	STORED
+//
+// "> n" introduces n bytes sent by the client, and "< n" n bytes sent by the server.
+// Lines starting with '#' between chunks are comments, and blank lines are ignored.
+// Consecutive chunks in the same direction form a single turn, so how reads and writes
+// were split while recording doesn't matter.
+package transcript
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Turn is data sent in one direction before the other side speaks.
+type Turn struct {
+	FromClient bool
+	Data       []byte
+}
+
+// Transcript is the sequence of turns of a session.
+type Transcript []Turn
+
+func (t Transcript) add(fromClient bool, data []byte) Transcript {
+	if n := len(t); n > 0 && t[n-1].FromClient == fromClient {
+		t[n-1].Data = append(t[n-1].Data, data...)
+		return t
+	}
+	return append(t, Turn{FromClient: fromClient, Data: append([]byte(nil), data...)})
+}
+
+// SyntaxError describes a malformed transcript.
+type SyntaxError string
+
+func (se SyntaxError) Error() string {
+	return fmt.Sprintf("transcript: syntax error: %s", string(se))
+}
+
+// Read parses a transcript.
+func Read(r io.Reader) (Transcript, error) {
+	br := bufio.NewReader(r)
+	var t Transcript
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return t, nil
+		}
+		if err != nil {
+			return nil, SyntaxError("unexpected end of header")
+		}
+
+		line = line[:len(line)-1]
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if len(line) < 3 || (line[0] != '>' && line[0] != '<') || line[1] != ' ' {
+			return nil, SyntaxError(fmt.Sprintf("malformed header: %q", line))
+		}
+		size, err := strconv.Atoi(line[2:])
+		if err != nil || size < 0 {
+			return nil, SyntaxError(fmt.Sprintf("malformed size: %q", line))
+		}
+
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(br, data); err != nil || data[size] != '\n' {
+			return nil, SyntaxError(fmt.Sprintf("truncated data after %q", line))
+		}
+		t = t.add(line[0] == '>', data[:size])
+	}
+}
+
+// Write writes t in the transcript format.
+func (t Transcript) Write(w io.Writer) error {
+	for _, turn := range t {
+		if err := writeChunk(w, turn.FromClient, turn.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeChunk(w io.Writer, fromClient bool, data []byte) error {
+	direction := '<'
+	if fromClient {
+		direction = '>'
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%c %d\n", direction, len(data))
+	b.Write(data)
+	b.WriteByte('\n')
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// Recorder is a net.Conn writing the traffic of the connection it wraps to a transcript.
+// The connection is the client side.
+type Recorder struct {
+	net.Conn
+
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewRecorder creates a Recorder of conn writing to w.
+func NewRecorder(conn net.Conn, w io.Writer) *Recorder {
+	return &Recorder{Conn: conn, w: w}
+}
+
+func (r *Recorder) record(fromClient bool, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err == nil {
+		r.err = writeChunk(r.w, fromClient, data)
+	}
+}
+
+// Read reads from the connection and records the bytes received from the server.
+func (r *Recorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	r.record(false, p[:n])
+	return n, err
+}
+
+// Write writes to the connection and records the bytes sent by the client.
+func (r *Recorder) Write(p []byte) (int, error) {
+	n, err := r.Conn.Write(p)
+	r.record(true, p[:n])
+	return n, err
+}
+
+// Err returns the first error writing the transcript.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
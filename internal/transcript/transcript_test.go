@@ -0,0 +1,92 @@
+package transcript
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+	"github.com/ttakezawa/memalpha/textproto"
+)
+
+func TestReadWrite(t *testing.T) {
+	input := "# a comment\n" +
+		"> 20\nset foo 0 0 3\r\nbar\r\n\n" +
+		"> 0\n\n" +
+		"< 4\nSTOR\n" +
+		"< 4\nED\r\n\n" +
+		"\n"
+	transcript, err := Read(strings.NewReader(input))
+	assert.NoError(t, err)
+	assert.Equal(t, Transcript{
+		{FromClient: true, Data: []byte("set foo 0 0 3\r\nbar\r\n")},
+		{FromClient: false, Data: []byte("STORED\r\n")},
+	}, transcript)
+
+	var b bytes.Buffer
+	assert.NoError(t, transcript.Write(&b))
+	assert.Equal(t, "> 20\nset foo 0 0 3\r\nbar\r\n\n< 8\nSTORED\r\n\n", b.String())
+
+	for _, input := range []string{"> 20", "? 1\nx\n", "> x\n", "> 10\nshort\n", "> 1\nxy"} {
+		_, err := Read(strings.NewReader(input))
+		assert.IsType(t, SyntaxError(""), err, input)
+	}
+}
+
+func session(t *testing.T, c *textproto.TextConn) {
+	assert.NoError(t, c.Set("foo", []byte("bar"), 42, 0, false))
+	value, flags, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), value)
+	assert.EqualValues(t, 42, flags)
+	_, err = c.Increment("foo", 1, false)
+	assert.Error(t, err)
+	assert.NoError(t, c.Close())
+}
+
+func TestRecordReplay(t *testing.T) {
+	memd := memdtest.NewMemd()
+	if err := memd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = memd.Close() }()
+
+	netConn, err := net.Dial("tcp", memd.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	recorder := NewRecorder(netConn, &b)
+	session(t, textproto.NewConn(recorder))
+	assert.NoError(t, recorder.Err())
+
+	transcript, err := Read(&b)
+	assert.NoError(t, err)
+	assert.Len(t, transcript, 6)
+
+	// The same session passes against the transcript.
+	r := NewReplayer(transcript)
+	session(t, textproto.NewConn(r.Conn()))
+	assert.NoError(t, r.Wait())
+
+	// A diverging session fails.
+	r = NewReplayer(transcript)
+	c := textproto.NewConn(r.Conn())
+	assert.Error(t, c.Set("foo", []byte("bar"), 0, 0, false), "the replayer hangs up")
+	_ = c.Close()
+	err = r.Wait()
+	if assert.IsType(t, &MismatchError{}, err) {
+		assert.Equal(t, 0, err.(*MismatchError).Turn)
+		assert.Equal(t, []byte("set foo 0 0 3 \r\nbar\r\n"), err.(*MismatchError).Actual)
+	}
+
+	// So does a session going on after the transcript.
+	r = NewReplayer(transcript[:2])
+	c = textproto.NewConn(r.Conn())
+	assert.NoError(t, c.Set("foo", []byte("bar"), 42, 0, false))
+	assert.NoError(t, c.Set("foo", []byte("bar"), 42, 0, true))
+	_ = c.Close()
+	assert.IsType(t, &MismatchError{}, r.Wait())
+}
@@ -0,0 +1,24 @@
+package memalpha
+
+// MaxKeyLength is the maximum length of a memcached key.
+const MaxKeyLength = 250
+
+// IllegalKeyByte reports whether c cannot appear in a key: whitespace and control
+// characters would break the command line.
+func IllegalKeyByte(c byte) bool {
+	return c <= ' ' || c == 0x7f
+}
+
+// LegalKey reports whether key can be sent in a command line without breaking the
+// protocol. Commands fail with ErrMalformedKey for any other key.
+func LegalKey(key string) bool {
+	if len(key) == 0 || len(key) > MaxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if IllegalKeyByte(key[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,19 @@
+package memalpha_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+func TestLegalKey(t *testing.T) {
+	for _, key := range []string{"foo", "user:42", "日本語", strings.Repeat("A", memalpha.MaxKeyLength)} {
+		assert.True(t, memalpha.LegalKey(key), "LegalKey(%q)", key)
+	}
+	for _, key := range []string{"", "foo bar", "a\r\nflush_all", "tab\t", "del\x7f", strings.Repeat("A", memalpha.MaxKeyLength+1)} {
+		assert.False(t, memalpha.LegalKey(key), "LegalKey(%q)", key)
+	}
+}
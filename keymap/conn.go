@@ -0,0 +1,145 @@
+package keymap
+
+import "github.com/ttakezawa/memalpha"
+
+// Conn wraps a memalpha.Conn and maps every key through a KeyMapper before it reaches
+// the server.
+type Conn struct {
+	memalpha.Conn
+	mapper KeyMapper
+}
+
+// NewConn returns a Conn mapping keys with mapper. If mapper is nil, DefaultMapper is
+// used.
+func NewConn(c memalpha.Conn, mapper KeyMapper) *Conn {
+	if mapper == nil {
+		mapper = DefaultMapper
+	}
+	return &Conn{Conn: c, mapper: mapper}
+}
+
+// Get returns a value, flags and error.
+func (c *Conn) Get(key string) (value []byte, flags uint32, err error) {
+	if key, err = c.mapper.MapKey(key); err != nil {
+		return nil, 0, err
+	}
+	return c.Conn.Get(key)
+}
+
+// Gets is an alternative get command for using with CAS. The returned map is keyed by the
+// original keys.
+func (c *Conn) Gets(keys []string) (map[string]*memalpha.Response, error) {
+	originals := make(map[string]string, len(keys))
+	mapped := make([]string, len(keys))
+	for i, key := range keys {
+		k, err := c.mapper.MapKey(key)
+		if err != nil {
+			return nil, err
+		}
+		originals[k] = key
+		mapped[i] = k
+	}
+
+	m, err := c.Conn.Gets(mapped)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]*memalpha.Response, len(m))
+	for k, response := range m {
+		result[originals[k]] = response
+	}
+	return result, nil
+}
+
+// Set means "store this data".
+func (c *Conn) Set(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	key, err := c.mapper.MapKey(key)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Set(key, value, flags, exptime, noreply)
+}
+
+// Add means "store this data, but only if the server *doesn't* already hold data for this
+// key".
+func (c *Conn) Add(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	key, err := c.mapper.MapKey(key)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Add(key, value, flags, exptime, noreply)
+}
+
+// Replace means "store this data, but only if the server *does* already hold data for
+// this key".
+func (c *Conn) Replace(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	key, err := c.mapper.MapKey(key)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Replace(key, value, flags, exptime, noreply)
+}
+
+// Append means "add this data to an existing key after existing data".
+func (c *Conn) Append(key string, value []byte, noreply bool) error {
+	key, err := c.mapper.MapKey(key)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Append(key, value, noreply)
+}
+
+// Prepend means "add this data to an existing key before existing data".
+func (c *Conn) Prepend(key string, value []byte, noreply bool) error {
+	key, err := c.mapper.MapKey(key)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Prepend(key, value, noreply)
+}
+
+// CompareAndSwap is a check and set operation which means "store this data but only if no
+// one else has updated since I last fetched it."
+func (c *Conn) CompareAndSwap(key string, value []byte, casid uint64, flags uint32, exptime int, noreply bool) error {
+	key, err := c.mapper.MapKey(key)
+	if err != nil {
+		return err
+	}
+	return c.Conn.CompareAndSwap(key, value, casid, flags, exptime, noreply)
+}
+
+// Delete deletes the item with the provided key
+func (c *Conn) Delete(key string, noreply bool) error {
+	key, err := c.mapper.MapKey(key)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Delete(key, noreply)
+}
+
+// Increment key by value.
+func (c *Conn) Increment(key string, value uint64, noreply bool) (uint64, error) {
+	key, err := c.mapper.MapKey(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Increment(key, value, noreply)
+}
+
+// Decrement key by value.
+func (c *Conn) Decrement(key string, value uint64, noreply bool) (uint64, error) {
+	key, err := c.mapper.MapKey(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Decrement(key, value, noreply)
+}
+
+// Touch is used to update the expiration time of an existing item without fetching it.
+func (c *Conn) Touch(key string, exptime int32, noreply bool) error {
+	key, err := c.mapper.MapKey(key)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Touch(key, exptime, noreply)
+}
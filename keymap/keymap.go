@@ -0,0 +1,144 @@
+// Package keymap maps arbitrary application keys to keys accepted by memcached.
+//
+// A Mapper with a Hash replaces long keys by a prefix, '#' and a digest. To keep such
+// keys from colliding with application keys, it also hashes every key containing '#',
+// however short: with SHA1, "a#b" maps to "a#b#" followed by the digest of "a#b".
+package keymap
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cespare/xxhash"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+// KeyMapper maps an application key to a memcached key. Keys which cannot be mapped fail
+// with memalpha.ErrMalformedKey.
+type KeyMapper interface {
+	MapKey(key string) (string, error)
+}
+
+// HashFunc returns a printable digest of key.
+type HashFunc func(key string) string
+
+// SHA1 is a HashFunc returning the hex encoded SHA-1 digest.
+func SHA1(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// XXHash is a HashFunc returning the hex encoded xxHash64 digest.
+func XXHash(key string) string {
+	return fmt.Sprintf("%016x", xxhash.Sum64String(key))
+}
+
+// Mapper is the standard KeyMapper. The zero value only validates keys.
+type Mapper struct {
+	// Escape enables escaping of whitespace and control characters instead of rejecting
+	// them.
+	Escape bool
+
+	// Hash, if set, shortens keys longer than memalpha.MaxKeyLength. A shortened key
+	// keeps the beginning of the key followed by '#' and the digest, so it stays
+	// recognizable. Keys containing '#' are hashed whatever their length, so that they
+	// cannot collide with a shortened key.
+	Hash HashFunc
+}
+
+// DefaultMapper rejects keys which are not valid memcached keys.
+var DefaultMapper KeyMapper = Mapper{}
+
+// hashSeparator separates the beginning of a shortened key from its digest.
+const hashSeparator = '#'
+
+// MapKey returns the memcached key for key.
+func (m Mapper) MapKey(key string) (string, error) {
+	if key == "" {
+		return "", memalpha.ErrMalformedKey
+	}
+
+	if m.Escape {
+		key = EscapeKey(key)
+	} else if strings.IndexFunc(key, isIllegal) >= 0 {
+		return "", memalpha.ErrMalformedKey
+	}
+
+	if m.Hash != nil && (len(key) > memalpha.MaxKeyLength || strings.IndexByte(key, hashSeparator) >= 0) {
+		digest := m.Hash(key)
+		prefix := key
+		n := memalpha.MaxKeyLength - len(digest) - 1
+		if n < 0 {
+			n = 0
+		}
+		if len(prefix) > n {
+			prefix = prefix[:n]
+		}
+		key = prefix + string(hashSeparator) + digest
+	}
+	// The digest of a custom Hash may be too long or unprintable.
+	if !memalpha.LegalKey(key) {
+		return "", memalpha.ErrMalformedKey
+	}
+	return key, nil
+}
+
+func isIllegal(r rune) bool {
+	return r < 0x80 && memalpha.IllegalKeyByte(byte(r))
+}
+
+const escapeChar = '%'
+
+// EscapeKey replaces whitespace, control characters and '%' in key with %XX sequences.
+func EscapeKey(key string) string {
+	n := 0
+	for i := 0; i < len(key); i++ {
+		if c := key[i]; isIllegal(rune(c)) || c == escapeChar {
+			n++
+		}
+	}
+	if n == 0 {
+		return key
+	}
+
+	const hexDigits = "0123456789ABCDEF"
+	buf := make([]byte, 0, len(key)+2*n)
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if isIllegal(rune(c)) || c == escapeChar {
+			buf = append(buf, escapeChar, hexDigits[c>>4], hexDigits[c&0xf])
+		} else {
+			buf = append(buf, c)
+		}
+	}
+	return string(buf)
+}
+
+// UnescapeKey reverses EscapeKey.
+func UnescapeKey(key string) (string, error) {
+	if strings.IndexByte(key, escapeChar) < 0 {
+		return key, nil
+	}
+
+	buf := make([]byte, 0, len(key))
+	for i := 0; i < len(key); i++ {
+		if key[i] != escapeChar {
+			buf = append(buf, key[i])
+			continue
+		}
+		if i+2 >= len(key) {
+			return "", memalpha.ErrMalformedKey
+		}
+		c, err := strconv.ParseUint(key[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", memalpha.ErrMalformedKey
+		}
+		buf = append(buf, byte(c))
+		i += 2
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,120 @@
+package keymap
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/conntest"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+)
+
+func TestDefaultMapper(t *testing.T) {
+	for _, key := range []string{"foo", "user:42", "日本語", strings.Repeat("A", memalpha.MaxKeyLength)} {
+		mapped, err := DefaultMapper.MapKey(key)
+		assert.NoError(t, err, "MapKey(%q)", key)
+		assert.Equal(t, key, mapped, "MapKey(%q)", key)
+	}
+
+	for _, key := range []string{"", "foo bar", "a\r\nflush_all", "tab\t", "del\x7f", strings.Repeat("A", memalpha.MaxKeyLength+1)} {
+		_, err := DefaultMapper.MapKey(key)
+		assert.Equal(t, memalpha.ErrMalformedKey, err, "MapKey(%q)", key)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	m := Mapper{Escape: true}
+
+	mapped, err := m.MapKey("a b\r\n%")
+	assert.NoError(t, err)
+	assert.Equal(t, "a%20b%0D%0A%25", mapped)
+
+	original, err := UnescapeKey(mapped)
+	assert.NoError(t, err)
+	assert.Equal(t, "a b\r\n%", original)
+
+	for _, key := range []string{"%", "%4", "%zz"} {
+		_, err = UnescapeKey(key)
+		assert.Equal(t, memalpha.ErrMalformedKey, err, "UnescapeKey(%q)", key)
+	}
+}
+
+func TestHash(t *testing.T) {
+	long := strings.Repeat("A", 300)
+
+	for _, hash := range []HashFunc{SHA1, XXHash} {
+		m := Mapper{Hash: hash}
+		mapped, err := m.MapKey(long)
+		assert.NoError(t, err)
+		assert.Len(t, mapped, memalpha.MaxKeyLength)
+		assert.True(t, strings.HasPrefix(mapped, "AAAA"), mapped)
+		assert.True(t, strings.HasSuffix(mapped, "#"+hash(long)), mapped)
+
+		other, err := m.MapKey(long + "B")
+		assert.NoError(t, err)
+		assert.NotEqual(t, mapped, other)
+
+		// A raw key looking like a shortened one is hashed too.
+		lookalike, err := m.MapKey(mapped)
+		assert.NoError(t, err)
+		assert.NotEqual(t, mapped, lookalike)
+		assert.True(t, strings.HasSuffix(lookalike, "#"+hash(mapped)), lookalike)
+
+		withSeparator, err := m.MapKey("a#b")
+		assert.NoError(t, err)
+		assert.Equal(t, "a#b#"+hash("a#b"), withSeparator)
+
+		short, err := m.MapKey("foo")
+		assert.NoError(t, err)
+		assert.Equal(t, "foo", short)
+	}
+
+	// Digests of custom hashes must keep the key legal.
+	for _, hash := range []HashFunc{
+		func(string) string { return strings.Repeat("0", memalpha.MaxKeyLength) },
+		func(string) string { return "with space" },
+	} {
+		_, err := Mapper{Hash: hash}.MapKey(long)
+		assert.Equal(t, memalpha.ErrMalformedKey, err)
+	}
+}
+
+func TestConn(t *testing.T) {
+	backend := memdtest.NewFakeConn()
+	c := NewConn(backend, Mapper{Escape: true, Hash: SHA1})
+	long := strings.Repeat("L", 300)
+
+	for _, key := range []string{"foo bar", long} {
+		err := c.Set(key, []byte("val"), 0, 0, false)
+		assert.NoError(t, err, "set(%q)", key)
+
+		value, _, err := c.Get(key)
+		assert.NoError(t, err, "get(%q)", key)
+		assert.Equal(t, []byte("val"), value, "get(%q)", key)
+	}
+
+	_, _, err := backend.Get("foo%20bar")
+	assert.NoError(t, err, "escaped key is stored")
+
+	m, err := c.Gets([]string{"foo bar", long, "missing"})
+	assert.NoError(t, err)
+	assert.Len(t, m, 2)
+	assert.Equal(t, []byte("val"), m["foo bar"].Value)
+	assert.Equal(t, []byte("val"), m[long].Value)
+
+	err = NewConn(backend, nil).Set("foo bar", []byte("val"), 0, 0, false)
+	assert.Equal(t, memalpha.ErrMalformedKey, err)
+	_, err = NewConn(backend, nil).Gets([]string{"foo", "foo bar"})
+	assert.Equal(t, memalpha.ErrMalformedKey, err)
+}
+
+func TestConnConformance(t *testing.T) {
+	clock := memdtest.NewClock(time.Unix(1000, 0))
+	conntest.Run(t, func() (memalpha.Conn, error) {
+		backend := memdtest.NewFakeConn()
+		backend.Now = clock.Now
+		return NewConn(backend, Mapper{Escape: true, Hash: SHA1}), nil
+	}, clock.Advance)
+}
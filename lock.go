@@ -0,0 +1,130 @@
+package memalpha
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrLockLost means a Lease is no longer held, because it expired and possibly was
+	// acquired by someone else.
+	ErrLockLost = errors.New("memcache: lock lost")
+
+	// ErrInvalidLockTTL means a lock was requested for a zero or negative ttl, which
+	// would never expire.
+	ErrInvalidLockTTL = errors.New("memcache: lock ttl must be positive")
+)
+
+// DefaultLockRetryInterval is the default interval between attempts of Locker.Lock.
+const DefaultLockRetryInterval = 50 * time.Millisecond
+
+// Locker acquires distributed locks. A lock is an item holding the unique token of its
+// current lease.
+type Locker struct {
+	conn Conn
+
+	// Prefix is prepended to lock names to build keys.
+	Prefix string
+
+	// RetryInterval is the interval between attempts while the lock is held by someone
+	// else.
+	RetryInterval time.Duration
+}
+
+// NewLocker creates a Locker over conn.
+func NewLocker(conn Conn) *Locker {
+	return &Locker{
+		conn:          conn,
+		Prefix:        "lock:",
+		RetryInterval: DefaultLockRetryInterval,
+	}
+}
+
+// Lease is a held lock.
+type Lease struct {
+	conn  Conn
+	key   string
+	token []byte
+}
+
+// TryLock acquires the lock name for ttl. It returns ErrNotStored if the lock is held by
+// someone else.
+func (l *Locker) TryLock(name string, ttl time.Duration) (*Lease, error) {
+	if ttl <= 0 {
+		return nil, ErrInvalidLockTTL
+	}
+	token := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, token); err != nil {
+		return nil, err
+	}
+	lease := &Lease{
+		conn:  l.conn,
+		key:   l.Prefix + name,
+		token: []byte(hex.EncodeToString(token)),
+	}
+
+	if err := l.conn.Add(lease.key, lease.token, 0, Exptime(ttl), false); err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// Lock acquires the lock name for ttl, waiting until it is released or ctx is done.
+func (l *Locker) Lock(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	for {
+		lease, err := l.TryLock(name, ttl)
+		if err != ErrNotStored {
+			return lease, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(l.RetryInterval):
+		}
+	}
+}
+
+// Token returns the unique token of the lease.
+func (l *Lease) Token() string {
+	return string(l.token)
+}
+
+// compareAndSwap stores the token again with exptime, but only if the lease is still held.
+func (l *Lease) compareAndSwap(exptime int) error {
+	m, err := l.conn.Gets([]string{l.key})
+	if err != nil {
+		return err
+	}
+	response, ok := m[l.key]
+	if !ok || string(response.Value) != string(l.token) {
+		return ErrLockLost
+	}
+
+	err = l.conn.CompareAndSwap(l.key, l.token, response.CasID, 0, exptime, false)
+	if err == ErrCasConflict || err == ErrNotFound {
+		return ErrLockLost
+	}
+	return err
+}
+
+// Refresh extends the lease to expire ttl from now. It returns ErrLockLost if the lease
+// has already expired.
+func (l *Lease) Refresh(ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidLockTTL
+	}
+	return l.compareAndSwap(Exptime(ttl))
+}
+
+// Unlock releases the lock. It returns ErrLockLost and leaves the lock alone if the lease
+// has already expired, so that it never releases a lock acquired by someone else.
+func (l *Lease) Unlock() error {
+	// memcached cannot delete with a cas unique. Storing an already expired item has the
+	// same effect.
+	return l.compareAndSwap(-1)
+}
@@ -0,0 +1,70 @@
+package memalpha_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+)
+
+func TestLock(t *testing.T) {
+	conn := memdtest.NewFakeConn()
+	now := time.Unix(1000, 0)
+	conn.Now = func() time.Time { return now }
+	locker := memalpha.NewLocker(conn)
+	locker.RetryInterval = time.Millisecond
+
+	lease, err := locker.Lock(context.Background(), "job", 10*time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, lease.Token(), 32)
+
+	_, err = locker.TryLock("other", 0)
+	assert.Equal(t, memalpha.ErrInvalidLockTTL, err, "a lock must expire")
+	assert.Equal(t, memalpha.ErrInvalidLockTTL, lease.Refresh(time.Nanosecond-1))
+
+	_, err = locker.TryLock("job", 10*time.Second)
+	assert.Equal(t, memalpha.ErrNotStored, err, "the lock is held")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = locker.Lock(ctx, "job", 10*time.Second)
+	assert.Equal(t, context.DeadlineExceeded, err, "Lock waits until ctx is done")
+
+	// Refresh extends the lease.
+	now = now.Add(9 * time.Second)
+	assert.NoError(t, lease.Refresh(10*time.Second))
+	now = now.Add(9 * time.Second)
+	_, err = locker.TryLock("job", 10*time.Second)
+	assert.Equal(t, memalpha.ErrNotStored, err, "the lock is still held after refresh")
+
+	assert.NoError(t, lease.Unlock())
+	other, err := locker.TryLock("job", 10*time.Second)
+	assert.NoError(t, err, "the lock is released")
+	assert.NotEqual(t, lease.Token(), other.Token())
+}
+
+func TestLockLost(t *testing.T) {
+	conn := memdtest.NewFakeConn()
+	now := time.Unix(1000, 0)
+	conn.Now = func() time.Time { return now }
+	locker := memalpha.NewLocker(conn)
+
+	lease, err := locker.TryLock("job", time.Second)
+	assert.NoError(t, err)
+
+	// The lease expires and someone else acquires the lock.
+	now = now.Add(time.Second)
+	other, err := locker.TryLock("job", time.Minute)
+	assert.NoError(t, err)
+
+	assert.Equal(t, memalpha.ErrLockLost, lease.Refresh(time.Minute))
+	assert.Equal(t, memalpha.ErrLockLost, lease.Unlock())
+	_, err = locker.TryLock("job", time.Minute)
+	assert.Equal(t, memalpha.ErrNotStored, err, "the other lease is intact")
+
+	assert.NoError(t, other.Unlock())
+	assert.Equal(t, memalpha.ErrLockLost, other.Unlock(), "unlock twice")
+}
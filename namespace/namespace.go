@@ -0,0 +1,133 @@
+// Package namespace groups keys into namespaces which can be invalidated at once.
+//
+// Every namespace has a generation counter stored in memcached. Keys are prefixed with
+// "<namespace>:<generation>:", so bumping the generation makes all existing items of the
+// namespace unreachable; they are evicted by memcached in due course.
+package namespace
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/generation"
+	"github.com/ttakezawa/memalpha/keymap"
+)
+
+// generationKeyPrefix is the prefix of the keys holding the generation counters.
+const generationKeyPrefix = "nsgen:"
+
+type cachedGeneration struct {
+	value     uint64
+	fetchedAt time.Time
+}
+
+// Namespace manages the generations of namespaces. Generations are cached locally for
+// CacheTTL, so an invalidation by another process becomes visible after at most CacheTTL.
+type Namespace struct {
+	conn memalpha.Conn
+
+	// CacheTTL is how long a generation is cached locally. Zero disables the cache.
+	CacheTTL time.Duration
+
+	now         func() time.Time
+	mu          sync.Mutex
+	generations map[string]cachedGeneration
+}
+
+// New creates a Namespace storing generations through conn.
+func New(conn memalpha.Conn, cacheTTL time.Duration) *Namespace {
+	return &Namespace{
+		conn:        conn,
+		CacheTTL:    cacheTTL,
+		now:         time.Now,
+		generations: make(map[string]cachedGeneration),
+	}
+}
+
+func (n *Namespace) cached(namespace string) (uint64, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	g, ok := n.generations[namespace]
+	if !ok || n.now().Sub(g.fetchedAt) >= n.CacheTTL {
+		return 0, false
+	}
+	return g.value, true
+}
+
+func (n *Namespace) remember(namespace string, value uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.generations[namespace] = cachedGeneration{value: value, fetchedAt: n.now()}
+}
+
+func (n *Namespace) forget(namespace string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.generations, namespace)
+}
+
+// Generation returns the current generation of namespace, creating it if necessary.
+func (n *Namespace) Generation(namespace string) (uint64, error) {
+	if value, ok := n.cached(namespace); ok {
+		return value, nil
+	}
+
+	key := generationKeyPrefix + namespace
+	data, _, err := n.conn.Get(key)
+	var value uint64
+	switch err {
+	case nil:
+		value, err = generation.Parse(data)
+	case memalpha.ErrCacheMiss:
+		value, err = generation.Create(n.conn, key, n.now())
+	}
+	if err != nil {
+		return 0, err
+	}
+	n.remember(namespace, value)
+	return value, nil
+}
+
+// Key returns the key actually stored in memcached for key in namespace.
+func (n *Namespace) Key(namespace string, key string) (string, error) {
+	value, err := n.Generation(namespace)
+	if err != nil {
+		return "", err
+	}
+	return namespace + ":" + strconv.FormatUint(value, 10) + ":" + key, nil
+}
+
+// Invalidate makes all items of namespace unreachable by bumping its generation.
+func (n *Namespace) Invalidate(namespace string) error {
+	value, err := n.conn.Increment(generationKeyPrefix+namespace, 1, false)
+	if err == memalpha.ErrNotFound {
+		// No generation means no items.
+		n.forget(namespace)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	n.remember(namespace, value)
+	return nil
+}
+
+type mapper struct {
+	n         *Namespace
+	namespace string
+}
+
+func (m mapper) MapKey(key string) (string, error) {
+	return m.n.Key(m.namespace, key)
+}
+
+// Conn returns a memalpha.Conn which transparently prefixes every key with the current
+// generation of namespace.
+func (n *Namespace) Conn(namespace string) memalpha.Conn {
+	return keymap.NewConn(n.conn, mapper{n: n, namespace: namespace})
+}
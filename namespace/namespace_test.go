@@ -0,0 +1,88 @@
+package namespace
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+)
+
+func TestNamespace(t *testing.T) {
+	backend := memdtest.NewFakeConn()
+	n := New(backend, 0)
+	users := n.Conn("user:42")
+
+	err := users.Set("profile", []byte("alice"), 0, 0, false)
+	assert.NoError(t, err, "set(profile)")
+	value, _, err := users.Get("profile")
+	assert.NoError(t, err, "get(profile)")
+	assert.Equal(t, []byte("alice"), value, "get(profile)")
+
+	key, err := n.Key("user:42", "profile")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key, "user:42:"), key)
+	assert.True(t, strings.HasSuffix(key, ":profile"), key)
+	_, _, err = backend.Get(key)
+	assert.NoError(t, err, "prefixed key is stored")
+
+	// Other namespaces are not affected.
+	other := n.Conn("user:43")
+	err = other.Set("profile", []byte("bob"), 0, 0, false)
+	assert.NoError(t, err)
+
+	err = n.Invalidate("user:42")
+	assert.NoError(t, err, "invalidate(user:42)")
+	_, _, err = users.Get("profile")
+	assert.Equal(t, memalpha.ErrCacheMiss, err, "get(profile) after invalidate")
+	value, _, err = other.Get("profile")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bob"), value)
+
+	// Invalidating an unknown namespace is not an error.
+	err = n.Invalidate("unknown")
+	assert.NoError(t, err)
+}
+
+func TestGenerationCache(t *testing.T) {
+	backend := memdtest.NewFakeConn()
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+
+	n1 := New(backend, time.Second)
+	n1.now = clock
+	n2 := New(backend, time.Second)
+	n2.now = clock
+
+	g1, err := n1.Generation("ns")
+	assert.NoError(t, err)
+	g2, err := n2.Generation("ns")
+	assert.NoError(t, err)
+	assert.Equal(t, g1, g2, "both see the generation created by n1")
+
+	err = n2.Invalidate("ns")
+	assert.NoError(t, err)
+	g2, err = n2.Generation("ns")
+	assert.NoError(t, err)
+	assert.Equal(t, g1+1, g2, "the invalidating process sees the new generation at once")
+
+	g, err := n1.Generation("ns")
+	assert.NoError(t, err)
+	assert.Equal(t, g1, g, "n1 still uses its cached generation")
+
+	now = now.Add(time.Second)
+	g, err = n1.Generation("ns")
+	assert.NoError(t, err)
+	assert.Equal(t, g2, g, "n1 refetches after CacheTTL")
+}
+
+func TestMalformedGeneration(t *testing.T) {
+	backend := memdtest.NewFakeConn()
+	err := backend.Set(generationKeyPrefix+"ns", []byte("foo"), 0, 0, false)
+	assert.NoError(t, err)
+
+	_, err = New(backend, 0).Key("ns", "foo")
+	assert.Error(t, err)
+}
@@ -0,0 +1,83 @@
+package nearcache
+
+import (
+	"container/list"
+	"time"
+)
+
+type entry struct {
+	key      string
+	value    []byte
+	flags    uint32
+	casid    uint64
+	hasCasID bool
+	expireAt time.Time
+}
+
+func (e *entry) size() int {
+	return len(e.key) + len(e.value)
+}
+
+// lru is a least recently used cache bounded by the number of entries and their total
+// size. It is not safe for concurrent use.
+type lru struct {
+	maxItems int
+	maxBytes int
+	bytes    int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newLRU(maxItems int, maxBytes int) *lru {
+	return &lru{
+		maxItems: maxItems,
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *lru) get(key string, now time.Time) *entry {
+	elem, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	e := elem.Value.(*entry)
+	if !now.Before(e.expireAt) {
+		c.removeElement(elem)
+		return nil
+	}
+	c.ll.MoveToFront(elem)
+	return e
+}
+
+func (c *lru) add(e *entry) {
+	c.remove(e.key)
+	if e.size() > c.maxBytes {
+		return
+	}
+
+	c.items[e.key] = c.ll.PushFront(e)
+	c.bytes += e.size()
+	for c.ll.Len() > c.maxItems || c.bytes > c.maxBytes {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *lru) remove(key string) {
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *lru) removeElement(elem *list.Element) {
+	e := c.ll.Remove(elem).(*entry)
+	delete(c.items, e.key)
+	c.bytes -= e.size()
+}
+
+func (c *lru) clear() {
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.bytes = 0
+}
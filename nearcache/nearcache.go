@@ -0,0 +1,302 @@
+// Package nearcache keeps recently read items in process memory in front of memcached.
+//
+// A NearCache is shared by any number of connections wrapped with Wrap, typically all the
+// connections of a memalpha.Pool. Reads are served locally for up to TTL. Writes through
+// a wrapped connection go to memcached and update or drop the local copy, and can be
+// published to other processes through a Broadcaster.
+package nearcache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+// Broadcaster publishes the keys modified by this process, so that other processes can
+// drop them from their NearCache with Invalidate.
+type Broadcaster interface {
+	Publish(keys ...string) error
+}
+
+// NearCache is an in-process cache bounded by the number of items and their total size.
+// It is safe for concurrent use.
+type NearCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	// Broadcaster, if set, is notified of every key modified through a wrapped
+	// connection.
+	Broadcaster Broadcaster
+
+	mu  sync.Mutex
+	lru *lru
+
+	// fills counts the reads from the server in flight per key, and stale holds the
+	// keys modified during such a read. Values read before a modification must not
+	// replace the local copy.
+	fills map[string]int
+	stale map[string]bool
+}
+
+// New creates a NearCache holding up to maxItems items and maxBytes bytes of keys and
+// values, each for at most ttl.
+func New(maxItems int, maxBytes int, ttl time.Duration) *NearCache {
+	return &NearCache{
+		ttl:   ttl,
+		now:   time.Now,
+		lru:   newLRU(maxItems, maxBytes),
+		fills: make(map[string]int),
+		stale: make(map[string]bool),
+	}
+}
+
+// Invalidate drops keys from the local cache. Call it with the keys received from the
+// Broadcaster of other processes.
+func (nc *NearCache) Invalidate(keys ...string) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	for _, key := range keys {
+		nc.lru.remove(key)
+		nc.markStale(key)
+	}
+}
+
+// Purge drops all items from the local cache.
+func (nc *NearCache) Purge() {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	nc.lru.clear()
+	for key := range nc.fills {
+		nc.stale[key] = true
+	}
+}
+
+// markStale discards the values being read for key. nc.mu must be held.
+func (nc *NearCache) markStale(key string) {
+	if nc.fills[key] > 0 {
+		nc.stale[key] = true
+	}
+}
+
+func (nc *NearCache) get(key string, needCasID bool) *memalpha.Response {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	e := nc.lru.get(key, nc.now())
+	if e == nil || (needCasID && !e.hasCasID) {
+		return nil
+	}
+	return &memalpha.Response{
+		Value: append([]byte(nil), e.value...),
+		Flags: e.flags,
+		CasID: e.casid,
+	}
+}
+
+// set replaces the local copy of key with a value just written.
+func (nc *NearCache) set(key string, value []byte, flags uint32) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	nc.markStale(key)
+	// The new cas unique is unknown, so Gets still goes to the server.
+	nc.add(key, value, flags, 0, false)
+}
+
+// startFill is called before reading keys from the server, and endFill after, with the
+// response for key or nil. endFill keeps the response locally unless key was modified in
+// between.
+func (nc *NearCache) startFill(keys ...string) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	for _, key := range keys {
+		nc.fills[key]++
+	}
+}
+
+func (nc *NearCache) endFill(key string, response *memalpha.Response, hasCasID bool) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	if response != nil && !nc.stale[key] {
+		nc.add(key, response.Value, response.Flags, response.CasID, hasCasID)
+	}
+	if nc.fills[key]--; nc.fills[key] == 0 {
+		delete(nc.fills, key)
+		delete(nc.stale, key)
+	}
+}
+
+// add stores a local copy. nc.mu must be held.
+func (nc *NearCache) add(key string, value []byte, flags uint32, casid uint64, hasCasID bool) {
+	nc.lru.add(&entry{
+		key:      key,
+		value:    append([]byte(nil), value...),
+		flags:    flags,
+		casid:    casid,
+		hasCasID: hasCasID,
+		expireAt: nc.now().Add(nc.ttl),
+	})
+}
+
+// modified drops key locally and publishes it.
+func (nc *NearCache) modified(key string) error {
+	nc.Invalidate(key)
+	return nc.publish(key)
+}
+
+func (nc *NearCache) publish(key string) error {
+	if nc.Broadcaster == nil {
+		return nil
+	}
+	return nc.Broadcaster.Publish(key)
+}
+
+// Wrap returns a connection reading through nc.
+func (nc *NearCache) Wrap(c memalpha.Conn) *Conn {
+	return &Conn{Conn: c, nc: nc}
+}
+
+// Conn is a memalpha.Conn reading through a NearCache.
+type Conn struct {
+	memalpha.Conn
+	nc *NearCache
+}
+
+// Get returns a value, flags and error. A local copy is returned if there is one.
+func (c *Conn) Get(key string) (value []byte, flags uint32, err error) {
+	if response := c.nc.get(key, false); response != nil {
+		return response.Value, response.Flags, nil
+	}
+
+	c.nc.startFill(key)
+	value, flags, err = c.Conn.Get(key)
+	if err != nil {
+		c.nc.endFill(key, nil, false)
+		return nil, 0, err
+	}
+	c.nc.endFill(key, &memalpha.Response{Value: value, Flags: flags}, false)
+	return value, flags, nil
+}
+
+// Gets is an alternative get command for using with CAS. Only the keys without a local
+// copy are fetched from the server.
+func (c *Conn) Gets(keys []string) (map[string]*memalpha.Response, error) {
+	m := make(map[string]*memalpha.Response, len(keys))
+	var misses []string
+	for _, key := range keys {
+		if response := c.nc.get(key, true); response != nil {
+			m[key] = response
+		} else {
+			misses = append(misses, key)
+		}
+	}
+	if len(misses) == 0 {
+		return m, nil
+	}
+
+	c.nc.startFill(misses...)
+	fetched, err := c.Conn.Gets(misses)
+	for _, key := range misses {
+		c.nc.endFill(key, fetched[key], true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for key, response := range fetched {
+		m[key] = response
+	}
+	return m, nil
+}
+
+// Set means "store this data". The local copy is replaced by the new value.
+func (c *Conn) Set(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	if err := c.Conn.Set(key, value, flags, exptime, noreply); err != nil {
+		c.nc.Invalidate(key)
+		return err
+	}
+	if exptime < 0 {
+		c.nc.Invalidate(key)
+	} else {
+		c.nc.set(key, value, flags)
+	}
+	return c.nc.publish(key)
+}
+
+// Add means "store this data, but only if the server *doesn't* already hold data for this
+// key".
+func (c *Conn) Add(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	err := c.Conn.Add(key, value, flags, exptime, noreply)
+	return firstError(err, c.nc.modified(key))
+}
+
+// Replace means "store this data, but only if the server *does* already hold data for
+// this key".
+func (c *Conn) Replace(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	err := c.Conn.Replace(key, value, flags, exptime, noreply)
+	return firstError(err, c.nc.modified(key))
+}
+
+// Append means "add this data to an existing key after existing data".
+func (c *Conn) Append(key string, value []byte, noreply bool) error {
+	err := c.Conn.Append(key, value, noreply)
+	return firstError(err, c.nc.modified(key))
+}
+
+// Prepend means "add this data to an existing key before existing data".
+func (c *Conn) Prepend(key string, value []byte, noreply bool) error {
+	err := c.Conn.Prepend(key, value, noreply)
+	return firstError(err, c.nc.modified(key))
+}
+
+// CompareAndSwap is a check and set operation which means "store this data but only if no
+// one else has updated since I last fetched it."
+func (c *Conn) CompareAndSwap(key string, value []byte, casid uint64, flags uint32, exptime int, noreply bool) error {
+	err := c.Conn.CompareAndSwap(key, value, casid, flags, exptime, noreply)
+	return firstError(err, c.nc.modified(key))
+}
+
+// Delete deletes the item with the provided key.
+func (c *Conn) Delete(key string, noreply bool) error {
+	err := c.Conn.Delete(key, noreply)
+	return firstError(err, c.nc.modified(key))
+}
+
+// Increment key by value.
+func (c *Conn) Increment(key string, value uint64, noreply bool) (uint64, error) {
+	n, err := c.Conn.Increment(key, value, noreply)
+	return n, firstError(err, c.nc.modified(key))
+}
+
+// Decrement key by value.
+func (c *Conn) Decrement(key string, value uint64, noreply bool) (uint64, error) {
+	n, err := c.Conn.Decrement(key, value, noreply)
+	return n, firstError(err, c.nc.modified(key))
+}
+
+// Touch is used to update the expiration time of an existing item without fetching it.
+// The local copies are dropped, so that they don't outlive a shortened expiration.
+func (c *Conn) Touch(key string, exptime int32, noreply bool) error {
+	err := c.Conn.Touch(key, exptime, noreply)
+	return firstError(err, c.nc.modified(key))
+}
+
+// FlushAll invalidates all existing items immediately (by default) or after the delay
+// specified. The local cache is purged at once; other processes are not notified.
+func (c *Conn) FlushAll(delay int, noreply bool) error {
+	c.nc.Purge()
+	return c.Conn.FlushAll(delay, noreply)
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package nearcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+)
+
+type recordingBroadcaster struct {
+	keys []string
+}
+
+func (b *recordingBroadcaster) Publish(keys ...string) error {
+	b.keys = append(b.keys, keys...)
+	return nil
+}
+
+func TestNearCache(t *testing.T) {
+	backend := memdtest.NewFakeConn()
+	now := time.Unix(1000, 0)
+	nc := New(10, 1000, time.Second)
+	nc.now = func() time.Time { return now }
+	b := &recordingBroadcaster{}
+	nc.Broadcaster = b
+	c := nc.Wrap(backend)
+
+	assert.NoError(t, backend.Set("foo", []byte("v1"), 42, 0, false))
+	value, flags, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1"), value)
+	assert.EqualValues(t, 42, flags)
+
+	// Modified behind our back, the local copy is still served.
+	assert.NoError(t, backend.Set("foo", []byte("v2"), 0, 0, false))
+	value, flags, err = c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1"), value)
+	assert.EqualValues(t, 42, flags)
+
+	// Until the local TTL passes.
+	now = now.Add(time.Second)
+	value, _, err = c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), value)
+
+	// Another connection of the same NearCache shares the local copy.
+	value, _, err = nc.Wrap(memdtest.NewFakeConn()).Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), value)
+
+	// Write-through
+	assert.NoError(t, c.Set("foo", []byte("v3"), 0, 0, false))
+	assert.NoError(t, backend.Set("foo", []byte("v4"), 0, 0, false))
+	value, _, err = c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v3"), value)
+
+	assert.NoError(t, c.Delete("foo", false))
+	_, _, err = c.Get("foo")
+	assert.Equal(t, memalpha.ErrCacheMiss, err)
+
+	assert.Equal(t, []string{"foo", "foo"}, b.keys, "modifications are published")
+
+	// Invalidation from another process
+	assert.NoError(t, backend.Set("bar", []byte("v1"), 0, 0, false))
+	_, _, err = c.Get("bar")
+	assert.NoError(t, err)
+	assert.NoError(t, backend.Set("bar", []byte("v2"), 0, 0, false))
+	nc.Invalidate("bar")
+	value, _, err = c.Get("bar")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), value)
+}
+
+func TestNearCacheGets(t *testing.T) {
+	backend := memdtest.NewFakeConn()
+	c := New(10, 1000, time.Minute).Wrap(backend)
+
+	assert.NoError(t, c.Set("foo", []byte("foo"), 0, 0, false))
+	assert.NoError(t, backend.Set("bar", []byte("bar"), 0, 0, false))
+
+	m, err := c.Gets([]string{"foo", "bar", "baz"})
+	assert.NoError(t, err)
+	assert.Len(t, m, 2)
+
+	// Values from Gets carry a valid cas unique, even from the local cache.
+	m, err = c.Gets([]string{"foo"})
+	assert.NoError(t, err)
+	assert.NoError(t, c.CompareAndSwap("foo", []byte("swapped"), m["foo"].CasID, 0, 0, false))
+	value, _, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("swapped"), value)
+}
+
+// interleavingConn runs during after reading from the server, like a write of another
+// goroutine landing while the response is on its way.
+type interleavingConn struct {
+	memalpha.Conn
+	during func()
+}
+
+func (c *interleavingConn) Get(key string) ([]byte, uint32, error) {
+	value, flags, err := c.Conn.Get(key)
+	if c.during != nil {
+		during := c.during
+		c.during = nil
+		during()
+	}
+	return value, flags, err
+}
+
+func (c *interleavingConn) Gets(keys []string) (map[string]*memalpha.Response, error) {
+	m, err := c.Conn.Gets(keys)
+	if c.during != nil {
+		during := c.during
+		c.during = nil
+		during()
+	}
+	return m, err
+}
+
+func TestFillRace(t *testing.T) {
+	backend := memdtest.NewFakeConn()
+	nc := New(10, 1000, time.Minute)
+	reader := &interleavingConn{Conn: backend}
+	c, writer := nc.Wrap(reader), nc.Wrap(backend)
+
+	assert.NoError(t, backend.Set("foo", []byte("old"), 0, 0, false))
+	reader.during = func() {
+		assert.NoError(t, writer.Set("foo", []byte("new"), 0, 0, false))
+	}
+	value, _, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("old"), value)
+	value, _, err = c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), value, "a value read before a write is not kept")
+
+	assert.NoError(t, backend.Set("bar", []byte("old"), 0, 0, false))
+	reader.during = func() {
+		assert.NoError(t, backend.Set("bar", []byte("new"), 0, 0, false))
+		nc.Invalidate("bar")
+	}
+	_, err = c.Gets([]string{"bar"})
+	assert.NoError(t, err)
+	m, err := c.Gets([]string{"bar"})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), m["bar"].Value, "a value read before an invalidation is not kept")
+
+	// Reads after the write are cached again.
+	assert.NoError(t, backend.Set("foo", []byte("newer"), 0, 0, false))
+	value, _, err = c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), value)
+}
+
+func TestTouchInvalidates(t *testing.T) {
+	backend := memdtest.NewFakeConn()
+	nc := New(10, 1000, time.Minute)
+	b := &recordingBroadcaster{}
+	nc.Broadcaster = b
+	c := nc.Wrap(backend)
+
+	assert.NoError(t, backend.Set("foo", []byte("v1"), 0, 0, false))
+	_, _, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.NoError(t, c.Touch("foo", 10, false))
+	assert.Equal(t, []string{"foo"}, b.keys, "touches are published")
+
+	assert.NoError(t, backend.Set("foo", []byte("v2"), 0, 0, false))
+	value, _, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), value, "the local copy is dropped")
+}
+
+func TestLRU(t *testing.T) {
+	now := time.Unix(1000, 0)
+	expireAt := now.Add(time.Minute)
+	c := newLRU(2, 10)
+
+	c.add(&entry{key: "a", value: []byte("1"), expireAt: expireAt})
+	c.add(&entry{key: "b", value: []byte("2"), expireAt: expireAt})
+	assert.NotNil(t, c.get("a", now))
+	c.add(&entry{key: "c", value: []byte("3"), expireAt: expireAt})
+	assert.Nil(t, c.get("b", now), "the least recently used is evicted by count")
+	assert.NotNil(t, c.get("a", now))
+
+	c.add(&entry{key: "d", value: []byte("12345678"), expireAt: expireAt})
+	assert.Nil(t, c.get("c", now), "evicted by size")
+	assert.Nil(t, c.get("a", now), "evicted by size")
+	assert.NotNil(t, c.get("d", now))
+	assert.Equal(t, 9, c.bytes)
+
+	c.add(&entry{key: "e", value: []byte("too large!"), expireAt: expireAt})
+	assert.Nil(t, c.get("e", now), "an item larger than the limit is not cached")
+
+	assert.Nil(t, c.get("d", expireAt), "expired")
+	assert.Equal(t, 0, c.bytes)
+}
@@ -33,8 +33,12 @@ func (p *Pool) GetContext(ctx context.Context) (Conn, error) {
 	return p.DialContext(ctx)
 }
 
-// Put puts a connection into a pool.
+// Put puts a connection into a pool. A connection with a Broken method reporting true,
+// such as a textproto.TextConn left in the middle of a command, is closed instead.
 func (p *Pool) Put(c Conn) error {
+	if b, ok := c.(interface{ Broken() bool }); ok && b.Broken() {
+		return c.Close()
+	}
 	select {
 	case p.idleConns <- c:
 		return nil
@@ -0,0 +1,144 @@
+// Package ratelimit implements rate limits shared by many processes through memcached.
+//
+// Requests are counted in window keys which expire by themselves. A fixed-window limiter
+// allows Limit requests per window. A sliding-window limiter additionally weights the
+// count of the previous window by how much of it still overlaps the sliding window, which
+// smooths out bursts at window boundaries.
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+// FailMode decides what Allow does when memcached cannot be reached.
+type FailMode int
+
+const (
+	// FailOpen allows requests when memcached fails.
+	FailOpen FailMode = iota
+	// FailClosed denies requests when memcached fails.
+	FailClosed
+)
+
+// Result is the outcome of Allow.
+type Result struct {
+	// Allowed reports whether the request is within the limit.
+	Allowed bool
+	// Remaining is the number of requests still allowed in the current window.
+	Remaining uint64
+	// Reset is the end of the current window.
+	Reset time.Time
+}
+
+// Limiter limits the rate of requests per key.
+type Limiter struct {
+	pool    *memalpha.Pool
+	limit   uint64
+	window  time.Duration
+	sliding bool
+
+	// Prefix is prepended to the keys of the window counters.
+	Prefix string
+
+	// FailMode is applied when memcached fails.
+	FailMode FailMode
+
+	now func() time.Time
+}
+
+// NewFixedWindow creates a Limiter allowing limit requests per window.
+func NewFixedWindow(pool *memalpha.Pool, limit uint64, window time.Duration) *Limiter {
+	return &Limiter{
+		pool:   pool,
+		limit:  limit,
+		window: window,
+		Prefix: "rl:",
+		now:    time.Now,
+	}
+}
+
+// NewSlidingWindow creates a Limiter allowing approximately limit requests in any
+// window-long period.
+func NewSlidingWindow(pool *memalpha.Pool, limit uint64, window time.Duration) *Limiter {
+	l := NewFixedWindow(pool, limit, window)
+	l.sliding = true
+	return l
+}
+
+func (l *Limiter) windowKey(key string, index int64) string {
+	return l.Prefix + key + ":" + strconv.FormatInt(index, 10)
+}
+
+// Allow counts a request for key and reports whether it is within the limit. When
+// memcached fails, Allow returns a Result according to FailMode along with the error.
+func (l *Limiter) Allow(ctx context.Context, key string) (Result, error) {
+	now := l.now()
+	index := now.UnixNano() / int64(l.window)
+	windowStart := time.Unix(0, index*int64(l.window))
+	result := Result{Reset: windowStart.Add(l.window)}
+
+	conn, err := l.pool.GetContext(ctx)
+	if err != nil {
+		return l.fail(result), err
+	}
+
+	// Keep each window for two window lengths, so that a sliding limiter can still see
+	// the previous one.
+	ttl := 2*l.window + time.Second
+	count, err := memalpha.NewCounter(conn, l.windowKey(key, index), ttl).Add(1)
+	if err != nil {
+		l.release(conn, err)
+		return l.fail(result), err
+	}
+
+	estimate := float64(count)
+	if l.sliding {
+		previous, err := memalpha.NewCounter(conn, l.windowKey(key, index-1), ttl).Value()
+		if err != nil {
+			l.release(conn, err)
+			return l.fail(result), err
+		}
+		overlap := 1 - float64(now.Sub(windowStart))/float64(l.window)
+		estimate += float64(previous) * overlap
+	}
+	_ = l.pool.Put(conn)
+
+	if estimate <= float64(l.limit) {
+		result.Allowed = true
+		result.Remaining = uint64(float64(l.limit) - estimate)
+	}
+	return result, nil
+}
+
+// release returns conn to the pool after a command failed with err, unless err may have
+// left it unusable.
+func (l *Limiter) release(conn memalpha.Conn, err error) {
+	if isReply(err) {
+		_ = l.pool.Put(conn)
+		return
+	}
+	_ = conn.Close()
+}
+
+// isReply reports whether err is a regular reply or a rejected argument, which leave the
+// connection usable.
+func isReply(err error) bool {
+	switch err.(type) {
+	case memalpha.ClientError, memalpha.ServerError:
+		return true
+	}
+	switch err {
+	case memalpha.ErrMalformedKey, memalpha.ErrCacheMiss, memalpha.ErrNotFound, memalpha.ErrNotStored, memalpha.ErrCasConflict:
+		return true
+	}
+	return false
+}
+
+func (l *Limiter) fail(result Result) Result {
+	result.Allowed = l.FailMode == FailOpen
+	return result
+}
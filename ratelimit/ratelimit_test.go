@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+)
+
+func newPool(conn memalpha.Conn) *memalpha.Pool {
+	return memalpha.NewPool(func(context.Context) (memalpha.Conn, error) {
+		return conn, nil
+	}, 1)
+}
+
+func TestFixedWindow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewFixedWindow(newPool(memdtest.NewFakeConn()), 2, time.Minute)
+	l.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 1; i >= 0; i-- {
+		result, err := l.Allow(ctx, "client")
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.EqualValues(t, i, result.Remaining)
+		assert.Equal(t, time.Unix(1020, 0), result.Reset)
+	}
+
+	result, err := l.Allow(ctx, "client")
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed, "limit exceeded")
+	assert.EqualValues(t, 0, result.Remaining)
+
+	result, err = l.Allow(ctx, "other")
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed, "keys are limited separately")
+
+	now = now.Add(20 * time.Second)
+	result, err = l.Allow(ctx, "client")
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed, "next window")
+	assert.Equal(t, time.Unix(1080, 0), result.Reset)
+}
+
+func TestSlidingWindow(t *testing.T) {
+	now := time.Unix(960, 0)
+	l := NewSlidingWindow(newPool(memdtest.NewFakeConn()), 4, time.Minute)
+	l.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		result, err := l.Allow(ctx, "client")
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+	}
+
+	// A quarter into the next window, 3/4 of the previous count still applies.
+	now = now.Add(75 * time.Second)
+	result, err := l.Allow(ctx, "client")
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed, "1 + 4*0.75 = 4")
+	assert.EqualValues(t, 0, result.Remaining)
+	result, err = l.Allow(ctx, "client")
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed, "2 + 4*0.75 = 5")
+
+	// Half into the window, 3 + 4*0.5 = 5 is still denied, and the previous window
+	// fades out only gradually.
+	now = now.Add(15 * time.Second)
+	result, err = l.Allow(ctx, "client")
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+	now = now.Add(29 * time.Second)
+	result, err = l.Allow(ctx, "client")
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed, "4 + 4/60 > 4")
+}
+
+func TestFailMode(t *testing.T) {
+	failure := errors.New("dial failed")
+	pool := memalpha.NewPool(func(context.Context) (memalpha.Conn, error) {
+		return nil, failure
+	}, 1)
+
+	l := NewFixedWindow(pool, 1, time.Minute)
+	result, err := l.Allow(context.Background(), "client")
+	assert.Equal(t, failure, err)
+	assert.True(t, result.Allowed, "fail open")
+
+	l.FailMode = FailClosed
+	result, err = l.Allow(context.Background(), "client")
+	assert.Equal(t, failure, err)
+	assert.False(t, result.Allowed, "fail closed")
+}
+
+func TestLongWindow(t *testing.T) {
+	// Two windows last exactly the 30 days beyond which memcached reads an exptime as a
+	// timestamp.
+	l := NewFixedWindow(newPool(memdtest.NewFakeConn()), 1, 15*24*time.Hour)
+	ctx := context.Background()
+
+	result, err := l.Allow(ctx, "client")
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+	result, err = l.Allow(ctx, "client")
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed, "the window counter must not expire at once")
+}
+
+// keyRejectingConn rejects every key like a Conn validating keys before sending them.
+type keyRejectingConn struct {
+	*memdtest.FakeConn
+}
+
+func (keyRejectingConn) Increment(key string, value uint64, noreply bool) (uint64, error) {
+	return 0, memalpha.ErrMalformedKey
+}
+
+func TestReplyKeepsConn(t *testing.T) {
+	dials := 0
+	pool := memalpha.NewPool(func(context.Context) (memalpha.Conn, error) {
+		dials++
+		return keyRejectingConn{memdtest.NewFakeConn()}, nil
+	}, 1)
+	l := NewFixedWindow(pool, 1, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		_, err := l.Allow(context.Background(), "bad key")
+		assert.Equal(t, memalpha.ErrMalformedKey, err)
+	}
+	assert.Equal(t, 1, dials, "a rejected key doesn't discard the connection")
+}
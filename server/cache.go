@@ -0,0 +1,407 @@
+package server
+
+import (
+	"container/list"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+// Version is the version reported by Cache.
+const Version = "memalpha-1.0.0"
+
+// itemOverhead is the size accounted to an item in addition to its key and value.
+const itemOverhead = 48
+
+type item struct {
+	key      string
+	value    []byte
+	flags    uint32
+	casid    uint64
+	storedAt time.Time
+	expireAt time.Time
+}
+
+func (it *item) size() int {
+	return len(it.key) + len(it.value) + itemOverhead
+}
+
+type cacheStats struct {
+	totalItems uint64
+	cmdGet     uint64
+	cmdSet     uint64
+	cmdTouch   uint64
+	getHits    uint64
+	getMisses  uint64
+	evictions  uint64
+}
+
+// Cache is an in-memory store mimicking the replies of a memcached server. It implements
+// memalpha.Conn, so it can be used as a connection without any network I/O, and serves
+// the items of a Server. Items are evicted in least recently used order once their total
+// size exceeds the limit. It is safe for concurrent use.
+type Cache struct {
+	// Now returns the current time. It is used for expirations and may be replaced to
+	// control the clock from tests.
+	Now func() time.Time
+
+	maxBytes int
+	started  time.Time
+
+	mu      sync.Mutex
+	items   map[string]*list.Element
+	lru     *list.List
+	bytes   int
+	lastCas uint64
+	flushAt time.Time
+	stats   cacheStats
+}
+
+// NewCache creates an empty Cache holding up to maxBytes bytes of items, counting
+// keys, values and a fixed overhead per item. Zero means no limit.
+func NewCache(maxBytes int) *Cache {
+	return &Cache{
+		Now:      time.Now,
+		maxBytes: maxBytes,
+		started:  time.Now(),
+		items:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (c *Cache) expireAt(exptime int) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return c.Now()
+	case exptime > memalpha.MaxRelativeExptime:
+		return time.Unix(int64(exptime), 0)
+	}
+	return c.Now().Add(time.Duration(exptime) * time.Second)
+}
+
+func (c *Cache) remove(e *list.Element) {
+	it := c.lru.Remove(e).(*item)
+	delete(c.items, it.key)
+	c.bytes -= it.size()
+}
+
+// lookup returns the live item for key and marks it as recently used.
+func (c *Cache) lookup(key string) *item {
+	e, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	it := e.Value.(*item)
+	now := c.Now()
+	expired := !it.expireAt.IsZero() && !now.Before(it.expireAt)
+	flushed := !c.flushAt.IsZero() && !now.Before(c.flushAt) && it.storedAt.Before(c.flushAt)
+	if expired || flushed {
+		c.remove(e)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return it
+}
+
+// put links it in place of any item with the same key, evicting the least recently used
+// items if needed.
+func (c *Cache) put(it *item) error {
+	if c.maxBytes > 0 && it.size() > c.maxBytes {
+		if e, ok := c.items[it.key]; ok {
+			c.remove(e)
+		}
+		return memalpha.ServerError("out of memory storing object")
+	}
+
+	if e, ok := c.items[it.key]; ok {
+		c.remove(e)
+	}
+	c.lastCas++
+	it.casid = c.lastCas
+	it.storedAt = c.Now()
+	c.items[it.key] = c.lru.PushFront(it)
+	c.bytes += it.size()
+
+	for c.maxBytes > 0 && c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.stats.evictions++
+	}
+	return nil
+}
+
+func (c *Cache) store(key string, value []byte, flags uint32, exptime int) error {
+	c.stats.totalItems++
+	return c.put(&item{
+		key:      key,
+		value:    append([]byte(nil), value...),
+		flags:    flags,
+		expireAt: c.expireAt(exptime),
+	})
+}
+
+// Close does nothing.
+func (c *Cache) Close() error {
+	return nil
+}
+
+// Get returns a value, flags and error.
+func (c *Cache) Get(key string) (value []byte, flags uint32, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.cmdGet++
+	it := c.lookup(key)
+	if it == nil {
+		c.stats.getMisses++
+		return nil, 0, memalpha.ErrCacheMiss
+	}
+	c.stats.getHits++
+	return append([]byte(nil), it.value...), it.flags, nil
+}
+
+// Gets returns the items found for keys.
+func (c *Cache) Gets(keys []string) (map[string]*memalpha.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := make(map[string]*memalpha.Response)
+	for _, key := range keys {
+		c.stats.cmdGet++
+		it := c.lookup(key)
+		if it == nil {
+			c.stats.getMisses++
+			continue
+		}
+		c.stats.getHits++
+		m[key] = &memalpha.Response{
+			Value: append([]byte(nil), it.value...),
+			Flags: it.flags,
+			CasID: it.casid,
+		}
+	}
+	return m, nil
+}
+
+// Set stores the item unconditionally.
+func (c *Cache) Set(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.cmdSet++
+	return reply(c.store(key, value, flags, exptime), noreply)
+}
+
+// Add stores the item only if key is absent.
+func (c *Cache) Add(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.cmdSet++
+	if c.lookup(key) != nil {
+		return reply(memalpha.ErrNotStored, noreply)
+	}
+	return reply(c.store(key, value, flags, exptime), noreply)
+}
+
+// Replace stores the item only if key is present.
+func (c *Cache) Replace(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.cmdSet++
+	if c.lookup(key) == nil {
+		return reply(memalpha.ErrNotStored, noreply)
+	}
+	return reply(c.store(key, value, flags, exptime), noreply)
+}
+
+// Append adds value after the existing data.
+func (c *Cache) Append(key string, value []byte, noreply bool) error {
+	return c.concat(key, value, false, noreply)
+}
+
+// Prepend adds value before the existing data.
+func (c *Cache) Prepend(key string, value []byte, noreply bool) error {
+	return c.concat(key, value, true, noreply)
+}
+
+func (c *Cache) concat(key string, value []byte, prepend bool, noreply bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.cmdSet++
+	it := c.lookup(key)
+	if it == nil {
+		return reply(memalpha.ErrNotStored, noreply)
+	}
+	newItem := *it
+	if prepend {
+		newItem.value = append(append([]byte(nil), value...), it.value...)
+	} else {
+		newItem.value = append(append([]byte(nil), it.value...), value...)
+	}
+	return reply(c.put(&newItem), noreply)
+}
+
+// CompareAndSwap stores the item only if casid still matches.
+func (c *Cache) CompareAndSwap(key string, value []byte, casid uint64, flags uint32, exptime int, noreply bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.cmdSet++
+	it := c.lookup(key)
+	if it == nil {
+		return reply(memalpha.ErrNotFound, noreply)
+	}
+	if it.casid != casid {
+		return reply(memalpha.ErrCasConflict, noreply)
+	}
+	return reply(c.store(key, value, flags, exptime), noreply)
+}
+
+// Delete deletes the item with the provided key.
+func (c *Cache) Delete(key string, noreply bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lookup(key) == nil {
+		return reply(memalpha.ErrNotFound, noreply)
+	}
+	c.remove(c.items[key])
+	return nil
+}
+
+// Increment key by value. The new value wraps around at 64 bits.
+func (c *Cache) Increment(key string, value uint64, noreply bool) (uint64, error) {
+	return c.incrDecr(key, func(n uint64) uint64 { return n + value }, noreply)
+}
+
+// Decrement key by value. The new value never goes below 0.
+func (c *Cache) Decrement(key string, value uint64, noreply bool) (uint64, error) {
+	return c.incrDecr(key, func(n uint64) uint64 {
+		if n < value {
+			return 0
+		}
+		return n - value
+	}, noreply)
+}
+
+func (c *Cache) incrDecr(key string, f func(uint64) uint64, noreply bool) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	it := c.lookup(key)
+	if it == nil {
+		return 0, reply(memalpha.ErrNotFound, noreply)
+	}
+	n, err := strconv.ParseUint(string(it.value), 10, 64)
+	if err != nil {
+		return 0, reply(memalpha.ClientError("cannot increment or decrement non-numeric value"), noreply)
+	}
+	n = f(n)
+	newItem := *it
+	newItem.value = strconv.AppendUint(nil, n, 10)
+	if err := c.put(&newItem); err != nil {
+		return 0, reply(err, noreply)
+	}
+	if noreply {
+		return 0, nil
+	}
+	return n, nil
+}
+
+// Touch updates the expiration time of an existing item.
+func (c *Cache) Touch(key string, exptime int32, noreply bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.cmdTouch++
+	it := c.lookup(key)
+	if it == nil {
+		return reply(memalpha.ErrNotFound, noreply)
+	}
+	it.expireAt = c.expireAt(int(exptime))
+	return nil
+}
+
+// Stats returns statistics for the default set and for the "slabs" and "settings" keys.
+// Other keys are rejected with ErrReplyError, like memcached does. As in memcached, the
+// counts include expired items which have not been reclaimed yet.
+func (c *Cache) Stats(statsKey string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch statsKey {
+	case "":
+		return map[string]string{
+			"pid":            strconv.Itoa(os.Getpid()),
+			"uptime":         strconv.FormatInt(int64(time.Since(c.started)/time.Second), 10),
+			"time":           strconv.FormatInt(c.Now().Unix(), 10),
+			"version":        Version,
+			"curr_items":     strconv.Itoa(len(c.items)),
+			"total_items":    strconv.FormatUint(c.stats.totalItems, 10),
+			"bytes":          strconv.Itoa(c.bytes),
+			"limit_maxbytes": strconv.Itoa(c.maxBytes),
+			"cmd_get":        strconv.FormatUint(c.stats.cmdGet, 10),
+			"cmd_set":        strconv.FormatUint(c.stats.cmdSet, 10),
+			"cmd_touch":      strconv.FormatUint(c.stats.cmdTouch, 10),
+			"get_hits":       strconv.FormatUint(c.stats.getHits, 10),
+			"get_misses":     strconv.FormatUint(c.stats.getMisses, 10),
+			"evictions":      strconv.FormatUint(c.stats.evictions, 10),
+		}, nil
+	case "slabs":
+		// There are no slabs; all the items are accounted as a single one.
+		return map[string]string{
+			"active_slabs":   "1",
+			"total_malloced": strconv.Itoa(c.bytes),
+		}, nil
+	case "settings":
+		return map[string]string{
+			"maxbytes":  strconv.Itoa(c.maxBytes),
+			"evictions": "on",
+		}, nil
+	}
+	return nil, memalpha.ErrReplyError
+}
+
+// FlushAll invalidates all existing items immediately, or the items stored until delay
+// seconds from now once that time has come.
+func (c *Cache) FlushAll(delay int, noreply bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if delay <= 0 {
+		c.items = make(map[string]*list.Element)
+		c.lru.Init()
+		c.bytes = 0
+		c.flushAt = time.Time{}
+		return nil
+	}
+	c.flushAt = c.Now().Add(time.Duration(delay) * time.Second)
+	return nil
+}
+
+// Version returns the version of the server.
+func (c *Cache) Version() (string, error) {
+	return Version, nil
+}
+
+// Quit does nothing.
+func (c *Cache) Quit() error {
+	return nil
+}
+
+// reply hides err when the caller asked for noreply, like a real server would.
+func reply(err error, noreply bool) error {
+	if noreply {
+		return nil
+	}
+	return err
+}
+
+var _ memalpha.Conn = (*Cache)(nil)
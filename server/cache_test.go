@@ -0,0 +1,77 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/conntest"
+)
+
+func TestCacheEviction(t *testing.T) {
+	// Room for three items with a key and a value of one byte each.
+	c := NewCache(3 * (2 + itemOverhead))
+
+	assert.NoError(t, c.Set("a", []byte("1"), 0, 0, false))
+	assert.NoError(t, c.Set("b", []byte("2"), 0, 0, false))
+	assert.NoError(t, c.Set("c", []byte("3"), 0, 0, false))
+	_, _, err := c.Get("a")
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.Set("d", []byte("4"), 0, 0, false))
+	_, _, err = c.Get("b")
+	assert.Equal(t, memalpha.ErrCacheMiss, err, "the least recently used item is evicted")
+	for _, key := range []string{"a", "c", "d"} {
+		_, _, err = c.Get(key)
+		assert.NoError(t, err, key)
+	}
+
+	// Growing an item evicts others too.
+	assert.NoError(t, c.Append("a", []byte("12"), false))
+	_, _, err = c.Get("c")
+	assert.Equal(t, memalpha.ErrCacheMiss, err)
+
+	stats, err := c.Stats("")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", stats["evictions"])
+	assert.Equal(t, "2", stats["curr_items"])
+	assert.Equal(t, "102", stats["bytes"])
+
+	err = c.Set("a", make([]byte, 3*(2+itemOverhead)), 0, 0, false)
+	assert.Equal(t, memalpha.ServerError("out of memory storing object"), err)
+	_, _, err = c.Get("a")
+	assert.Equal(t, memalpha.ErrCacheMiss, err, "the old value is dropped")
+}
+
+func TestCacheExpiration(t *testing.T) {
+	now := time.Unix(3000000, 0)
+	c := NewCache(0)
+	c.Now = func() time.Time { return now }
+
+	assert.NoError(t, c.Set("relative", []byte("1"), 0, 10, false))
+	assert.NoError(t, c.Set("absolute", []byte("1"), 0, 3000005, false))
+	assert.NoError(t, c.Set("expired", []byte("1"), 0, -1, false))
+	m, err := c.Gets([]string{"relative", "absolute", "expired"})
+	assert.NoError(t, err)
+	assert.Len(t, m, 2)
+
+	now = now.Add(5 * time.Second)
+	_, _, err = c.Get("absolute")
+	assert.Equal(t, memalpha.ErrCacheMiss, err)
+	_, _, err = c.Get("relative")
+	assert.NoError(t, err)
+
+	now = now.Add(5 * time.Second)
+	_, _, err = c.Get("relative")
+	assert.Equal(t, memalpha.ErrCacheMiss, err)
+}
+
+func TestCacheConformance(t *testing.T) {
+	now := time.Unix(1000, 0)
+	conntest.Run(t, func() (memalpha.Conn, error) {
+		c := NewCache(0)
+		c.Now = func() time.Time { return now }
+		return c, nil
+	}, func(d time.Duration) { now = now.Add(d) })
+}
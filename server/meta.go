@@ -0,0 +1,276 @@
+package server
+
+import (
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+// The meta commands of memcached 1.6 are supported with these flags:
+//
+//	mg <key> [v] [f] [c] [s] [k] [T<ttl>] [O<opaque>] [q]
+//	ms <key> <datalen> [F<flags>] [T<ttl>] [C<cas>] [M<mode>] [k] [O<opaque>] [q]
+//	md <key> [k] [O<opaque>] [q]
+//	ma <key> [D<delta>] [M<mode>] [v] [k] [O<opaque>] [q]
+//	mn
+//
+// The q flag hides the HD, EN and NF replies.
+
+const replyInvalidFlag = "CLIENT_ERROR invalid flag"
+
+// metaFlags are the flags of a meta command. ret holds the flags copied back in the reply,
+// in the order they were requested.
+type metaFlags struct {
+	tokens map[byte]string
+	ret    []string
+	quiet  bool
+}
+
+// parseMetaFlags parses the flags of a command on key, reporting whether each flag is in
+// supported.
+func parseMetaFlags(key string, args []string, supported string) (*metaFlags, bool) {
+	f := &metaFlags{tokens: make(map[byte]string)}
+	for _, arg := range args {
+		flag := arg[0]
+		if strings.IndexByte(supported, flag) < 0 {
+			return nil, false
+		}
+		f.tokens[flag] = arg[1:]
+		switch flag {
+		case 'q':
+			f.quiet = true
+		case 'O':
+			f.ret = append(f.ret, arg)
+		case 'k':
+			f.ret = append(f.ret, "k"+key)
+		}
+	}
+	return f, true
+}
+
+func (f *metaFlags) has(flag byte) bool {
+	_, ok := f.tokens[flag]
+	return ok
+}
+
+// metaReply writes a reply with the returned flags, unless it is hidden by the q flag.
+func (s *session) metaReply(f *metaFlags, code string, flags ...string) {
+	if f.quiet && (code == "HD" || code == "EN" || code == "NF") {
+		return
+	}
+	s.reply(strings.Join(append(append([]string{code}, flags...), f.ret...), " "))
+}
+
+// metaReplyError writes the reply for an error of the store.
+func (s *session) metaReplyError(f *metaFlags, err error) {
+	switch err {
+	case memalpha.ErrNotStored:
+		s.metaReply(f, "NS")
+	case memalpha.ErrNotFound, memalpha.ErrCacheMiss:
+		s.metaReply(f, "NF")
+	case memalpha.ErrCasConflict:
+		s.metaReply(f, "EX")
+	default:
+		s.replyError(err)
+	}
+}
+
+func (s *session) metaGet(args []string) {
+	if len(args) == 0 || !validKey(args[0]) {
+		s.reply(replyBadFormat)
+		return
+	}
+	key := args[0]
+	f, ok := parseMetaFlags(key, args[1:], "vfcskTOq")
+	if !ok {
+		s.reply(replyInvalidFlag)
+		return
+	}
+
+	store := s.server.Store
+	m, _ := store.Gets([]string{key})
+	response, ok := m[key]
+	if !ok {
+		s.metaReply(f, "EN")
+		return
+	}
+
+	if ttl, ok := f.tokens['T']; ok {
+		exptime, err := strconv.ParseInt(ttl, 10, 32)
+		if err != nil {
+			s.reply(replyBadFormat)
+			return
+		}
+		if err := store.Touch(key, int32(exptime), false); err != nil {
+			if err == memalpha.ErrNotFound {
+				s.metaReply(f, "EN")
+				return
+			}
+			s.replyError(err)
+			return
+		}
+	}
+
+	var flags []string
+	if f.has('f') {
+		flags = append(flags, "f"+strconv.FormatUint(uint64(response.Flags), 10))
+	}
+	if f.has('c') {
+		flags = append(flags, "c"+strconv.FormatUint(response.CasID, 10))
+	}
+	if f.has('s') {
+		flags = append(flags, "s"+strconv.Itoa(len(response.Value)))
+	}
+	if !f.has('v') {
+		s.metaReply(f, "HD", flags...)
+		return
+	}
+	s.metaReply(f, "VA", append([]string{strconv.Itoa(len(response.Value))}, flags...)...)
+	_, _ = s.w.Write(response.Value)
+	s.reply("")
+}
+
+// metaSet runs a ms command. It returns false if the data block can't be read.
+func (s *session) metaSet(args []string) bool {
+	if len(args) < 2 {
+		s.reply(replyBadFormat)
+		return true
+	}
+	key := args[0]
+	size, err := strconv.Atoi(args[1])
+	if !validKey(key) || err != nil || size < 0 {
+		return s.reject(replyBadFormat, args[1])
+	}
+	f, ok := parseMetaFlags(key, args[2:], "FTCMkOq")
+	if !ok {
+		return s.reject(replyInvalidFlag, args[1])
+	}
+
+	if size > s.server.MaxItemSize {
+		// Swallow the data block.
+		if _, err := io.CopyN(io.Discard, s.r, int64(size)+2); err != nil {
+			return false
+		}
+		s.reply(replyTooLarge)
+		return true
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(s.r, data); err != nil {
+		return false
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		s.reply(replyBadDataChunk)
+		return true
+	}
+	value := data[:size]
+
+	var flags uint64
+	var exptime int
+	var casid uint64
+	var err1, err2, err3 error
+	if token, ok := f.tokens['F']; ok {
+		flags, err1 = strconv.ParseUint(token, 10, 32)
+	}
+	if token, ok := f.tokens['T']; ok {
+		exptime, err2 = strconv.Atoi(token)
+	}
+	if token, ok := f.tokens['C']; ok {
+		casid, err3 = strconv.ParseUint(token, 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil {
+		s.reply(replyBadFormat)
+		return true
+	}
+
+	store := s.server.Store
+	mode := f.tokens['M']
+	switch {
+	case f.has('C') && (mode == "" || mode == "S" || mode == "s"):
+		err = store.CompareAndSwap(key, value, casid, uint32(flags), exptime, false)
+	case mode == "" || mode == "S" || mode == "s":
+		err = store.Set(key, value, uint32(flags), exptime, false)
+	case mode == "E" || mode == "e":
+		err = store.Add(key, value, uint32(flags), exptime, false)
+	case mode == "R" || mode == "r":
+		err = store.Replace(key, value, uint32(flags), exptime, false)
+	case mode == "A" || mode == "a":
+		err = store.Append(key, value, false)
+	case mode == "P" || mode == "p":
+		err = store.Prepend(key, value, false)
+	default:
+		s.reply(replyInvalidFlag)
+		return true
+	}
+	if err != nil {
+		s.metaReplyError(f, err)
+		return true
+	}
+	s.metaReply(f, "HD")
+	return true
+}
+
+func (s *session) metaDelete(args []string) {
+	if len(args) == 0 || !validKey(args[0]) {
+		s.reply(replyBadFormat)
+		return
+	}
+	f, ok := parseMetaFlags(args[0], args[1:], "kOq")
+	if !ok {
+		s.reply(replyInvalidFlag)
+		return
+	}
+
+	if err := s.server.Store.Delete(args[0], false); err != nil {
+		s.metaReplyError(f, err)
+		return
+	}
+	s.metaReply(f, "HD")
+}
+
+func (s *session) metaArithmetic(args []string) {
+	if len(args) == 0 || !validKey(args[0]) {
+		s.reply(replyBadFormat)
+		return
+	}
+	key := args[0]
+	f, ok := parseMetaFlags(key, args[1:], "DMvkOq")
+	if !ok {
+		s.reply(replyInvalidFlag)
+		return
+	}
+
+	delta := uint64(1)
+	if token, ok := f.tokens['D']; ok {
+		var err error
+		if delta, err = strconv.ParseUint(token, 10, 64); err != nil {
+			s.reply(replyBadDelta)
+			return
+		}
+	}
+
+	var n uint64
+	var err error
+	switch f.tokens['M'] {
+	case "", "I", "i", "+":
+		n, err = s.server.Store.Increment(key, delta, false)
+	case "D", "d", "-":
+		n, err = s.server.Store.Decrement(key, delta, false)
+	default:
+		s.reply(replyInvalidFlag)
+		return
+	}
+	if err != nil {
+		s.metaReplyError(f, err)
+		return
+	}
+	if !f.has('v') {
+		s.metaReply(f, "HD")
+		return
+	}
+	value := strconv.FormatUint(n, 10)
+	s.metaReply(f, "VA", strconv.Itoa(len(value)))
+	s.reply(value)
+}
@@ -0,0 +1,503 @@
+// Package server implements a memcached compatible server speaking the text protocol,
+// including the meta commands.
+//
+// A Server serves the items of any memalpha.Conn, typically a Cache, which keeps them in
+// memory bounded by size with LRU eviction.
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+// DefaultMaxItemSize is the default largest value accepted by a Server, like the -I
+// option of memcached.
+const DefaultMaxItemSize = 1024 * 1024
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("memcache: server closed")
+
+// Server serves the memcached text protocol, storing items in Store.
+type Server struct {
+	// Store holds the items.
+	Store memalpha.Conn
+
+	// MaxItemSize is the largest value accepted by storage commands.
+	MaxItemSize int
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[net.Conn]struct{}
+	closed     bool
+	wg         sync.WaitGroup
+	totalConns uint64
+}
+
+// New creates a Server storing items in store.
+func New(store memalpha.Conn) *Server {
+	return &Server{
+		Store:       store,
+		MaxItemSize: DefaultMaxItemSize,
+		listeners:   make(map[net.Listener]struct{}),
+		conns:       make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and calls Serve.
+func (srv *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+// Serve accepts connections on l and serves each of them in a new goroutine. It always
+// returns a non-nil error, ErrServerClosed after Close.
+func (srv *Server) Serve(l net.Listener) error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	srv.listeners[l] = struct{}{}
+	srv.wg.Add(1)
+	srv.mu.Unlock()
+	defer srv.wg.Done()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			delete(srv.listeners, l)
+			if srv.closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		srv.mu.Lock()
+		if srv.closed {
+			srv.mu.Unlock()
+			_ = conn.Close()
+			continue
+		}
+		srv.conns[conn] = struct{}{}
+		srv.totalConns++
+		srv.wg.Add(1)
+		srv.mu.Unlock()
+
+		go func() {
+			defer srv.wg.Done()
+			srv.handle(conn)
+
+			srv.mu.Lock()
+			delete(srv.conns, conn)
+			srv.mu.Unlock()
+			_ = conn.Close()
+		}()
+	}
+}
+
+// Close closes all listeners and connections, and waits for their goroutines to finish.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	srv.closed = true
+	var err error
+	for l := range srv.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for conn := range srv.conns {
+		_ = conn.Close()
+	}
+	srv.mu.Unlock()
+
+	srv.wg.Wait()
+	return err
+}
+
+// addStats adds the statistics known by the server to the ones of the store.
+func (srv *Server) addStats(statsKey string, stats map[string]string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	switch statsKey {
+	case "":
+		stats["curr_connections"] = strconv.Itoa(len(srv.conns))
+		stats["total_connections"] = strconv.FormatUint(srv.totalConns, 10)
+	case "settings":
+		stats["item_size_max"] = strconv.Itoa(srv.MaxItemSize)
+	}
+}
+
+func (srv *Server) handle(conn net.Conn) {
+	s := &session{
+		server: srv,
+		r:      bufio.NewReaderSize(conn, maxLineLength),
+		w:      bufio.NewWriter(conn),
+	}
+	for {
+		line, err := s.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// The rest of the line cannot be told apart from the next command.
+			s.reply(replyLineTooLong)
+			_ = s.w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if !s.execute(strings.Fields(string(line))) {
+			_ = s.w.Flush()
+			return
+		}
+		// Pipelined commands are answered together.
+		if s.r.Buffered() == 0 {
+			if err := s.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// maxLineLength bounds the length of a command line. Longer lines close the connection.
+const maxLineLength = 64 * 1024
+
+const (
+	replyLineTooLong  = "CLIENT_ERROR line too long"
+	replyBadFormat    = "CLIENT_ERROR bad command line format"
+	replyBadDataChunk = "CLIENT_ERROR bad data chunk"
+	replyTooLarge     = "SERVER_ERROR object too large for cache"
+	replyBadDelta     = "CLIENT_ERROR invalid numeric delta argument"
+)
+
+type session struct {
+	server  *Server
+	r       *bufio.Reader
+	w       *bufio.Writer
+	noreply bool
+}
+
+func (s *session) reply(line string) {
+	if s.noreply {
+		return
+	}
+	_, _ = s.w.WriteString(line)
+	_, _ = s.w.WriteString("\r\n")
+}
+
+// replyError writes the reply for an error of the store.
+func (s *session) replyError(err error) {
+	switch e := err.(type) {
+	case memalpha.ClientError:
+		s.reply("CLIENT_ERROR " + string(e))
+		return
+	case memalpha.ServerError:
+		s.reply("SERVER_ERROR " + string(e))
+		return
+	}
+
+	switch err {
+	case memalpha.ErrNotStored:
+		s.reply("NOT_STORED")
+	case memalpha.ErrNotFound:
+		s.reply("NOT_FOUND")
+	case memalpha.ErrCasConflict:
+		s.reply("EXISTS")
+	default:
+		s.reply("ERROR")
+	}
+}
+
+// execute runs a command. It returns false when the connection must be closed.
+func (s *session) execute(args []string) bool {
+	s.noreply = false
+	if len(args) == 0 {
+		s.reply("ERROR")
+		return true
+	}
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "get", "gets":
+		s.retrieve(args, cmd == "gets")
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return s.store(cmd, args)
+	case "delete":
+		s.delete(args)
+	case "incr", "decr":
+		s.incrDecr(cmd, args)
+	case "touch":
+		s.touch(args)
+	case "stats":
+		s.stats(args)
+	case "flush_all":
+		s.flushAll(args)
+	case "version":
+		s.version()
+	case "mg":
+		s.metaGet(args)
+	case "ms":
+		return s.metaSet(args)
+	case "md":
+		s.metaDelete(args)
+	case "ma":
+		s.metaArithmetic(args)
+	case "mn":
+		s.reply("MN")
+	case "verbosity":
+		s.parseNoreply(args, 1)
+		s.reply("OK")
+	case "quit":
+		return false
+	default:
+		s.reply("ERROR")
+	}
+	return true
+}
+
+// parseNoreply sets s.noreply if args has an extra "noreply" after n arguments, and
+// reports whether args has a valid length.
+func (s *session) parseNoreply(args []string, n int) bool {
+	if len(args) == n+1 && args[n] == "noreply" {
+		s.noreply = true
+		return true
+	}
+	return len(args) == n
+}
+
+// validKey reports whether key, already split from the command line, is short enough.
+func validKey(key string) bool {
+	return len(key) <= memalpha.MaxKeyLength
+}
+
+func (s *session) retrieve(keys []string, withCas bool) {
+	if len(keys) == 0 {
+		s.reply("ERROR")
+		return
+	}
+	for _, key := range keys {
+		if !validKey(key) {
+			s.reply(replyBadFormat)
+			return
+		}
+	}
+
+	m, _ := s.server.Store.Gets(keys)
+	for _, key := range keys {
+		response, ok := m[key]
+		if !ok {
+			continue
+		}
+		if withCas {
+			s.reply(fmt.Sprintf("VALUE %s %d %d %d", key, response.Flags, len(response.Value), response.CasID))
+		} else {
+			s.reply(fmt.Sprintf("VALUE %s %d %d", key, response.Flags, len(response.Value)))
+		}
+		_, _ = s.w.Write(response.Value)
+		s.reply("")
+	}
+	s.reply("END")
+}
+
+// reject replies to a storage command whose line is invalid. Its data block is swallowed
+// if size parses, so that it isn't read as commands. It returns false if the data block
+// can't be read.
+func (s *session) reject(reply string, size string) bool {
+	if n, err := strconv.Atoi(size); err == nil && n >= 0 {
+		if _, err := io.CopyN(io.Discard, s.r, int64(n)+2); err != nil {
+			return false
+		}
+	}
+	s.reply(reply)
+	return true
+}
+
+// store runs a storage command. It returns false if the data block can't be read.
+func (s *session) store(cmd string, args []string) bool {
+	n := 4
+	if cmd == "cas" {
+		n = 5
+	}
+	if !s.parseNoreply(args, n) {
+		if len(args) < 4 {
+			s.reply(replyBadFormat)
+			return true
+		}
+		return s.reject(replyBadFormat, args[3])
+	}
+	key := args[0]
+	flags, err1 := strconv.ParseUint(args[1], 10, 32)
+	exptime, err2 := strconv.Atoi(args[2])
+	size, err3 := strconv.Atoi(args[3])
+	var casid uint64
+	var err4 error
+	if cmd == "cas" {
+		casid, err4 = strconv.ParseUint(args[4], 10, 64)
+	}
+	if !validKey(key) || err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 {
+		return s.reject(replyBadFormat, args[3])
+	}
+
+	if size > s.server.MaxItemSize {
+		// Swallow the data block.
+		if _, err := io.CopyN(io.Discard, s.r, int64(size)+2); err != nil {
+			return false
+		}
+		s.reply(replyTooLarge)
+		return true
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(s.r, data); err != nil {
+		return false
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		s.reply(replyBadDataChunk)
+		return true
+	}
+	value := data[:size]
+
+	store := s.server.Store
+	var err error
+	switch cmd {
+	case "set":
+		err = store.Set(key, value, uint32(flags), exptime, false)
+	case "add":
+		err = store.Add(key, value, uint32(flags), exptime, false)
+	case "replace":
+		err = store.Replace(key, value, uint32(flags), exptime, false)
+	case "append":
+		err = store.Append(key, value, false)
+	case "prepend":
+		err = store.Prepend(key, value, false)
+	case "cas":
+		err = store.CompareAndSwap(key, value, casid, uint32(flags), exptime, false)
+	}
+	if err != nil {
+		s.replyError(err)
+		return true
+	}
+	s.reply("STORED")
+	return true
+}
+
+func (s *session) delete(args []string) {
+	// "delete <key> 0" is accepted for backward compatibility.
+	if len(args) >= 2 && args[1] == "0" {
+		args = append(args[:1], args[2:]...)
+	}
+	if !s.parseNoreply(args, 1) || !validKey(args[0]) {
+		s.reply(replyBadFormat)
+		return
+	}
+
+	if err := s.server.Store.Delete(args[0], false); err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply("DELETED")
+}
+
+func (s *session) incrDecr(cmd string, args []string) {
+	if !s.parseNoreply(args, 2) || !validKey(args[0]) {
+		s.reply(replyBadFormat)
+		return
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		s.reply(replyBadDelta)
+		return
+	}
+
+	var n uint64
+	if cmd == "incr" {
+		n, err = s.server.Store.Increment(args[0], delta, false)
+	} else {
+		n, err = s.server.Store.Decrement(args[0], delta, false)
+	}
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(strconv.FormatUint(n, 10))
+}
+
+func (s *session) touch(args []string) {
+	if !s.parseNoreply(args, 2) || !validKey(args[0]) {
+		s.reply(replyBadFormat)
+		return
+	}
+	exptime, err := strconv.ParseInt(args[1], 10, 32)
+	if err != nil {
+		s.reply(replyBadFormat)
+		return
+	}
+
+	if err := s.server.Store.Touch(args[0], int32(exptime), false); err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply("TOUCHED")
+}
+
+func (s *session) stats(args []string) {
+	statsKey := strings.Join(args, " ")
+	stats, err := s.server.Store.Stats(statsKey)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.server.addStats(statsKey, stats)
+
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s.reply(fmt.Sprintf("STAT %s %s", name, stats[name]))
+	}
+	s.reply("END")
+}
+
+func (s *session) flushAll(args []string) {
+	delay := 0
+	if len(args) > 0 && args[0] != "noreply" {
+		var err error
+		if delay, err = strconv.Atoi(args[0]); err != nil {
+			s.reply(replyBadFormat)
+			return
+		}
+		args = args[1:]
+	}
+	if !s.parseNoreply(args, 0) {
+		s.reply(replyBadFormat)
+		return
+	}
+
+	_ = s.server.Store.FlushAll(delay, false)
+	s.reply("OK")
+}
+
+func (s *session) version() {
+	version, err := s.server.Store.Version()
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply("VERSION " + version)
+}
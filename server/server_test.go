@@ -0,0 +1,222 @@
+package server_test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+	"github.com/ttakezawa/memalpha/server"
+)
+
+type rawClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *rawClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &rawClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends request and checks that the following replies are expected.
+func (c *rawClient) do(request string, expected ...string) {
+	if _, err := c.conn.Write([]byte(request)); err != nil {
+		c.t.Fatal(err)
+	}
+	for _, line := range expected {
+		reply, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("request %q: %s", request, err)
+		}
+		assert.Equal(c.t, line+"\r\n", reply, "request %q", request)
+	}
+}
+
+func startServer(t *testing.T, cache *server.Cache, maxItemSize int) (*server.Server, string) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.New(cache)
+	srv.MaxItemSize = maxItemSize
+	go func() { _ = srv.Serve(l) }()
+	return srv, l.Addr().String()
+}
+
+func startServerWithClock(t *testing.T) (*server.Server, *server.Cache, *memdtest.Clock, *rawClient) {
+	cache := server.NewCache(0)
+	clock := memdtest.NewClock(time.Unix(1000, 0))
+	cache.Now = clock.Now
+	srv, addr := startServer(t, cache, server.DefaultMaxItemSize)
+	return srv, cache, clock, dial(t, addr)
+}
+
+func TestServer(t *testing.T) {
+	srv, _, clock, c := startServerWithClock(t)
+	defer func() { _ = srv.Close() }()
+
+	c.do("set foo 42 10 3\r\nbar\r\n", "STORED")
+	c.do("get foo missing foo\r\n", "VALUE foo 42 3", "bar", "VALUE foo 42 3", "bar", "END")
+	c.do("gets foo\r\n", "VALUE foo 42 3 1", "bar", "END")
+	c.do("add foo 0 0 1\r\nx\r\n", "NOT_STORED")
+	c.do("replace missing 0 0 1\r\nx\r\n", "NOT_STORED")
+	c.do("append foo 0 0 1\r\n!\r\n", "STORED")
+	c.do("prepend foo 0 0 1\r\n>\r\n", "STORED")
+	c.do("cas foo 0 0 1 1\r\nx\r\n", "EXISTS")
+	c.do("cas foo 0 0 1 3\r\nx\r\n", "STORED")
+	c.do("cas missing 0 0 1 3\r\nx\r\n", "NOT_FOUND")
+
+	// noreply commands only answer the following command.
+	c.do("set n 0 0 1 noreply\r\n1\r\nadd n 0 0 1 noreply\r\n2\r\nincr n 41 noreply\r\nget n\r\n",
+		"VALUE n 0 2", "42", "END")
+
+	c.do("incr n 8\r\n", "50")
+	c.do("decr n 100\r\n", "0")
+	c.do("incr foo 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	c.do("incr n x\r\n", "CLIENT_ERROR invalid numeric delta argument")
+	c.do("incr missing 1\r\n", "NOT_FOUND")
+
+	// Expirations follow the clock of the store.
+	clock.Advance(9 * time.Second)
+	c.do("touch foo 5\r\n", "TOUCHED")
+	clock.Advance(2 * time.Second)
+	c.do("get foo\r\n", "VALUE foo 0 1", "x", "END")
+	clock.Advance(3 * time.Second)
+	c.do("get foo\r\n", "END")
+	c.do("touch foo 5\r\n", "NOT_FOUND")
+
+	c.do("delete n\r\n", "DELETED")
+	c.do("delete n\r\n", "NOT_FOUND")
+
+	c.do("version\r\n", "VERSION "+server.Version)
+	c.do("verbosity 1\r\n", "OK")
+	c.do("bogus\r\n", "ERROR")
+	c.do("get\r\n", "ERROR")
+	c.do("set foo 0 0\r\n", "CLIENT_ERROR bad command line format")
+	c.do("get "+strings.Repeat("k", 251)+"\r\n", "CLIENT_ERROR bad command line format")
+	// The data block of a rejected storage command is swallowed when its length parses.
+	c.do("set foo x 0 1\r\nx\r\n", "CLIENT_ERROR bad command line format")
+	c.do("set foo 0 0 1 extra noreply\r\nx\r\n", "CLIENT_ERROR bad command line format")
+	c.do("cas foo 0 0 1\r\nx\r\n", "CLIENT_ERROR bad command line format")
+	c.do("set "+strings.Repeat("k", 251)+" 0 0 1\r\nx\r\n", "CLIENT_ERROR bad command line format")
+	c.do("set foo 0 0 x\r\n", "CLIENT_ERROR bad command line format")
+	c.do("version\r\n", "VERSION "+server.Version)
+	// The rest of a bad data chunk is read as a command, like memcached does.
+	c.do("set foo 0 0 1\r\nxyz\r\n", "CLIENT_ERROR bad data chunk", "ERROR")
+
+	c.do("quit\r\n")
+	_, err := c.r.ReadString('\n')
+	assert.Error(t, err, "connection is closed")
+}
+
+func TestMeta(t *testing.T) {
+	srv, _, _, c := startServerWithClock(t)
+	defer func() { _ = srv.Close() }()
+
+	c.do("ms foo 3 F42 T10 O1\r\nbar\r\n", "HD O1")
+	c.do("mg foo v f c s k O2\r\n", "VA 3 f42 c1 s3 kfoo O2", "bar")
+	c.do("mg foo f\r\n", "HD f42")
+	c.do("mg missing v O3\r\n", "EN O3")
+	c.do("mg missing v q O4\r\nmn\r\n", "MN")
+	c.do("ms foo 1 ME O5\r\nx\r\n", "NS O5")
+	c.do("ms foo 1 MA\r\n!\r\n", "HD")
+	c.do("ms foo 1 MP\r\n>\r\n", "HD")
+	c.do("ms foo 1 C1\r\nx\r\n", "EX")
+	c.do("ms foo 1 C3 q O6\r\nx\r\nmn\r\n", "MN")
+	c.do("ms missing 1 MR\r\nx\r\n", "NS")
+	c.do("mg foo T0 O7\r\n", "HD O7")
+	c.do("mg missing T0\r\n", "EN")
+
+	c.do("ms n 2\r\n40\r\n", "HD")
+	c.do("ma n v O8\r\n", "VA 2 O8", "41")
+	c.do("ma n D41 MD v\r\n", "VA 1", "0")
+	c.do("ma n\r\n", "HD")
+	c.do("ma missing O9\r\n", "NF O9")
+	c.do("ma foo\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+
+	c.do("md n O10\r\n", "HD O10")
+	c.do("md n q O11\r\nmd foo O12\r\n", "HD O12")
+	c.do("md foo\r\n", "NF")
+
+	c.do("mg foo x\r\n", "CLIENT_ERROR invalid flag")
+	c.do("ms foo x\r\n", "CLIENT_ERROR bad command line format")
+	c.do("ms foo 1 MX\r\nx\r\n", "CLIENT_ERROR invalid flag")
+	c.do("ms "+strings.Repeat("k", 251)+" 1\r\nx\r\n", "CLIENT_ERROR bad command line format")
+	c.do("mn\r\n", "MN")
+}
+
+func TestFlushAll(t *testing.T) {
+	srv, _, clock, c := startServerWithClock(t)
+	defer func() { _ = srv.Close() }()
+
+	c.do("set a 0 0 1\r\n1\r\n", "STORED")
+	c.do("flush_all\r\n", "OK")
+	c.do("get a\r\n", "END")
+
+	c.do("set a 0 0 1\r\n1\r\n", "STORED")
+	c.do("flush_all 10 noreply\r\nget a\r\n", "VALUE a 0 1", "1", "END")
+	clock.Advance(5 * time.Second)
+	c.do("set b 0 0 1\r\n2\r\n", "STORED")
+	clock.Advance(5 * time.Second)
+	c.do("get a b\r\n", "END")
+
+	c.do("set a 0 0 1\r\n1\r\n", "STORED")
+	c.do("get a\r\n", "VALUE a 0 1", "1", "END")
+}
+
+func TestStats(t *testing.T) {
+	srv, cache, _, c := startServerWithClock(t)
+	defer func() { _ = srv.Close() }()
+
+	c.do("set a 0 0 1\r\n1\r\n", "STORED")
+	c.do("stats slabs\r\n", "STAT active_slabs 1", "STAT total_malloced 50", "END")
+	c.do("stats settings\r\n", "STAT evictions on", "STAT item_size_max 1048576", "STAT maxbytes 0", "END")
+	c.do("stats bogus\r\n", "ERROR")
+
+	stats, err := cache.Stats("")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", stats["curr_items"])
+	assert.Equal(t, "1000", stats["time"])
+}
+
+func TestMaxItemSize(t *testing.T) {
+	srv, addr := startServer(t, server.NewCache(0), 4)
+	defer func() { _ = srv.Close() }()
+	c := dial(t, addr)
+
+	c.do("set foo 0 0 4\r\n1234\r\n", "STORED")
+	c.do("set foo 0 0 5\r\n12345\r\nget foo\r\n", "SERVER_ERROR object too large for cache",
+		"VALUE foo 0 4", "1234", "END")
+}
+
+func TestLineTooLong(t *testing.T) {
+	srv, addr := startServer(t, server.NewCache(0), server.DefaultMaxItemSize)
+	defer func() { _ = srv.Close() }()
+	c := dial(t, addr)
+
+	c.do("get "+strings.Repeat("a", 64*1024-4), "CLIENT_ERROR line too long")
+	_, err := c.r.ReadString('\n')
+	assert.Error(t, err, "the connection is closed")
+}
+
+func TestClose(t *testing.T) {
+	srv, addr := startServer(t, server.NewCache(0), server.DefaultMaxItemSize)
+	c := dial(t, addr)
+	c.do("version\r\n", "VERSION "+server.Version)
+
+	assert.NoError(t, srv.Close())
+	_, err := c.r.ReadString('\n')
+	assert.Error(t, err, "connections are closed")
+
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	assert.Equal(t, server.ErrServerClosed, srv.Serve(l))
+}
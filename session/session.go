@@ -0,0 +1,238 @@
+// Package session stores HTTP sessions in memcached.
+//
+// Sessions are identified by random IDs kept in a cookie. Every Load extends the
+// expiration of the session, and Save only overwrites a session if nobody else saved it
+// since it was loaded.
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/codec"
+)
+
+// ErrConflict means the session was saved by another request after it was loaded.
+var ErrConflict = errors.New("session: modified concurrently")
+
+// idSize is the number of random bytes of a session ID.
+const idSize = 32
+
+// Session is the data of a session.
+type Session struct {
+	ID     string
+	Values map[string]interface{}
+
+	casid uint64
+	isNew bool
+}
+
+// IsNew reports whether the session has not been saved yet.
+func (s *Session) IsNew() bool {
+	return s.isNew
+}
+
+// Store loads and saves sessions through connections of a pool.
+type Store struct {
+	pool *memalpha.Pool
+
+	// Codec serializes session values. The codec ID is kept in the item flags.
+	Codec codec.Codec
+
+	// TTL is how long a session lives after its last use.
+	TTL time.Duration
+
+	// Prefix is prepended to session IDs to build keys.
+	Prefix string
+
+	// Cookie is the template of the session cookie. Its Value and MaxAge are set by the
+	// Store.
+	Cookie http.Cookie
+}
+
+// NewStore creates a Store with sessions expiring after ttl of inactivity.
+func NewStore(pool *memalpha.Pool, ttl time.Duration) *Store {
+	return &Store{
+		pool:   pool,
+		Codec:  codec.JSON,
+		TTL:    ttl,
+		Prefix: "session:",
+		Cookie: http.Cookie{
+			Name:     "session",
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+	}
+}
+
+func (s *Store) exptime() int {
+	return memalpha.Exptime(s.TTL)
+}
+
+func newID() (string, error) {
+	b := make([]byte, idSize)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// validID reports whether id could have been made by newID. Anything else from a cookie
+// is ignored.
+func validID(id string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(id)
+	return err == nil && len(b) == idSize
+}
+
+// withConn runs f with a connection of the pool.
+func (s *Store) withConn(ctx context.Context, f func(memalpha.Conn) error) error {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	if err = f(conn); err != nil && !isReply(err) {
+		_ = conn.Close()
+		return err
+	}
+	_ = s.pool.Put(conn)
+	return err
+}
+
+// isReply reports whether err is a regular reply which leaves the connection usable.
+func isReply(err error) bool {
+	switch err {
+	case memalpha.ErrCacheMiss, memalpha.ErrNotFound, memalpha.ErrNotStored, memalpha.ErrCasConflict, ErrConflict, codec.ErrCodecMismatch:
+		return true
+	}
+	return false
+}
+
+// Load returns the session of r and extends its expiration. If r has no valid session, a
+// new empty session is returned.
+func (s *Store) Load(r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(s.Cookie.Name)
+	if err != nil || !validID(cookie.Value) {
+		return s.newSession()
+	}
+
+	sess := &Session{ID: cookie.Value}
+	key := s.Prefix + sess.ID
+	err = s.withConn(r.Context(), func(conn memalpha.Conn) error {
+		m, err := conn.Gets([]string{key})
+		if err != nil {
+			return err
+		}
+		response, ok := m[key]
+		if !ok {
+			return memalpha.ErrCacheMiss
+		}
+		if response.Flags != uint32(s.Codec.ID()) {
+			return codec.ErrCodecMismatch
+		}
+		if err = s.Codec.Unmarshal(response.Value, &sess.Values); err != nil {
+			return err
+		}
+		sess.casid = response.CasID
+
+		// Sliding expiration
+		return conn.Touch(key, int32(s.exptime()), true)
+	})
+	if err == memalpha.ErrCacheMiss {
+		return s.newSession()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sess.Values == nil {
+		sess.Values = make(map[string]interface{})
+	}
+	return sess, nil
+}
+
+func (s *Store) newSession() (*Session, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	return &Session{ID: id, Values: make(map[string]interface{}), isNew: true}, nil
+}
+
+// Save stores sess and sets the session cookie on w. It returns ErrConflict if the
+// session was saved by someone else since it was loaded; reload it and try again.
+func (s *Store) Save(w http.ResponseWriter, r *http.Request, sess *Session) error {
+	data, err := s.Codec.Marshal(sess.Values)
+	if err != nil {
+		return err
+	}
+
+	key := s.Prefix + sess.ID
+	flags := uint32(s.Codec.ID())
+	err = s.withConn(r.Context(), func(conn memalpha.Conn) error {
+		if sess.isNew {
+			// A random ID never collides in practice, but never overwrite someone
+			// else's session.
+			err = conn.Add(key, data, flags, s.exptime(), false)
+			if err == memalpha.ErrNotStored {
+				return ErrConflict
+			}
+		} else if sess.casid == 0 {
+			// The session changed under us since it was last saved.
+			return ErrConflict
+		} else {
+			err = conn.CompareAndSwap(key, data, sess.casid, flags, s.exptime(), false)
+			if err == memalpha.ErrCasConflict || err == memalpha.ErrNotFound {
+				return ErrConflict
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		// Pick up the new cas unique, so that the session can be saved again. Someone
+		// else may have saved in between; their cas unique is only adopted along with
+		// a value equal to ours, or the next Save would overwrite their changes.
+		sess.casid = 0
+		m, err := conn.Gets([]string{key})
+		if err != nil {
+			return err
+		}
+		if response, ok := m[key]; ok && bytes.Equal(response.Value, data) {
+			sess.casid = response.CasID
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sess.isNew = false
+
+	cookie := s.Cookie
+	cookie.Value = sess.ID
+	// Max-Age is always relative, unlike the exptime of long TTLs.
+	cookie.MaxAge = int((s.TTL + time.Second - 1) / time.Second)
+	http.SetCookie(w, &cookie)
+	return nil
+}
+
+// Destroy deletes sess and expires the session cookie on w.
+func (s *Store) Destroy(w http.ResponseWriter, r *http.Request, sess *Session) error {
+	err := s.withConn(r.Context(), func(conn memalpha.Conn) error {
+		return conn.Delete(s.Prefix+sess.ID, false)
+	})
+	if err != nil && err != memalpha.ErrNotFound {
+		return err
+	}
+
+	cookie := s.Cookie
+	cookie.MaxAge = -1
+	http.SetCookie(w, &cookie)
+	return nil
+}
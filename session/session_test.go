@@ -0,0 +1,166 @@
+package session
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+)
+
+func newStore(conn memalpha.Conn) *Store {
+	return NewStore(memalpha.NewPool(func(context.Context) (memalpha.Conn, error) {
+		return conn, nil
+	}, 1), time.Minute)
+}
+
+func requestWithCookies(cookies []*http.Cookie) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+func TestSession(t *testing.T) {
+	conn := memdtest.NewFakeConn()
+	now := time.Unix(1000, 0)
+	conn.Now = func() time.Time { return now }
+	store := newStore(conn)
+
+	// A request without a cookie gets a new session.
+	sess, err := store.Load(requestWithCookies(nil))
+	assert.NoError(t, err)
+	assert.True(t, sess.IsNew())
+	assert.Empty(t, sess.Values)
+
+	sess.Values["user"] = "alice"
+	w := httptest.NewRecorder()
+	err = store.Save(w, requestWithCookies(nil), sess)
+	assert.NoError(t, err)
+	assert.False(t, sess.IsNew())
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, sess.ID, cookies[0].Value)
+	assert.Equal(t, 60, cookies[0].MaxAge)
+	assert.True(t, cookies[0].HttpOnly)
+
+	// Loading extends the expiration.
+	for i := 0; i < 3; i++ {
+		now = now.Add(50 * time.Second)
+		loaded, err := store.Load(requestWithCookies(cookies))
+		assert.NoError(t, err)
+		assert.False(t, loaded.IsNew())
+		assert.Equal(t, sess.ID, loaded.ID)
+		assert.Equal(t, "alice", loaded.Values["user"])
+	}
+
+	// Saving twice works.
+	sess.Values["user"] = "bob"
+	assert.NoError(t, store.Save(httptest.NewRecorder(), requestWithCookies(cookies), sess))
+	sess.Values["user"] = "carol"
+	assert.NoError(t, store.Save(httptest.NewRecorder(), requestWithCookies(cookies), sess))
+
+	w = httptest.NewRecorder()
+	err = store.Destroy(w, requestWithCookies(cookies), sess)
+	assert.NoError(t, err)
+	assert.Equal(t, -1, w.Result().Cookies()[0].MaxAge)
+	loaded, err := store.Load(requestWithCookies(cookies))
+	assert.NoError(t, err)
+	assert.True(t, loaded.IsNew(), "destroyed")
+	assert.NotEqual(t, sess.ID, loaded.ID)
+
+	// Expired
+	sess, err = store.Load(requestWithCookies(nil))
+	assert.NoError(t, err)
+	w = httptest.NewRecorder()
+	assert.NoError(t, store.Save(w, requestWithCookies(nil), sess))
+	now = now.Add(time.Minute)
+	loaded, err = store.Load(requestWithCookies(w.Result().Cookies()))
+	assert.NoError(t, err)
+	assert.True(t, loaded.IsNew(), "expired")
+
+	// A forged ID is ignored.
+	loaded, err = store.Load(requestWithCookies([]*http.Cookie{{Name: "session", Value: "a\r\nflush_all"}}))
+	assert.NoError(t, err)
+	assert.True(t, loaded.IsNew())
+}
+
+func TestLongTTL(t *testing.T) {
+	conn := memdtest.NewFakeConn()
+	store := newStore(conn)
+	store.TTL = 90 * 24 * time.Hour
+
+	sess, err := store.Load(requestWithCookies(nil))
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	assert.NoError(t, store.Save(w, requestWithCookies(nil), sess))
+	cookies := w.Result().Cookies()
+	assert.Equal(t, 90*24*60*60, cookies[0].MaxAge)
+
+	loaded, err := store.Load(requestWithCookies(cookies))
+	assert.NoError(t, err)
+	assert.False(t, loaded.IsNew(), "sessions with a TTL over 30 days are stored")
+}
+
+func TestConcurrentSave(t *testing.T) {
+	store := newStore(memdtest.NewFakeConn())
+
+	sess, err := store.Load(requestWithCookies(nil))
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	assert.NoError(t, store.Save(w, requestWithCookies(nil), sess))
+	cookies := w.Result().Cookies()
+
+	first, err := store.Load(requestWithCookies(cookies))
+	assert.NoError(t, err)
+	second, err := store.Load(requestWithCookies(cookies))
+	assert.NoError(t, err)
+
+	first.Values["n"] = 1.0
+	assert.NoError(t, store.Save(httptest.NewRecorder(), requestWithCookies(cookies), first))
+	second.Values["n"] = 2.0
+	err = store.Save(httptest.NewRecorder(), requestWithCookies(cookies), second)
+	assert.Equal(t, ErrConflict, err)
+
+	loaded, err := store.Load(requestWithCookies(cookies))
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, loaded.Values["n"])
+}
+
+// racingConn saves the session of someone else right after each successful cas.
+type racingConn struct {
+	memalpha.Conn
+}
+
+func (c racingConn) CompareAndSwap(key string, value []byte, casid uint64, flags uint32, exptime int, noreply bool) error {
+	if err := c.Conn.CompareAndSwap(key, value, casid, flags, exptime, noreply); err != nil {
+		return err
+	}
+	return c.Conn.Set(key, []byte(`{"n":3}`), flags, exptime, false)
+}
+
+func TestSaveRace(t *testing.T) {
+	conn := memdtest.NewFakeConn()
+	store := newStore(racingConn{conn})
+
+	sess, err := store.Load(requestWithCookies(nil))
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	assert.NoError(t, store.Save(w, requestWithCookies(nil), sess))
+	cookies := w.Result().Cookies()
+
+	sess.Values["n"] = 1.0
+	assert.NoError(t, store.Save(httptest.NewRecorder(), requestWithCookies(cookies), sess))
+	sess.Values["n"] = 2.0
+	err = store.Save(httptest.NewRecorder(), requestWithCookies(cookies), sess)
+	assert.Equal(t, ErrConflict, err, "the cas unique of the other save is not adopted")
+
+	loaded, err := store.Load(requestWithCookies(cookies))
+	assert.NoError(t, err)
+	assert.Equal(t, 3.0, loaded.Values["n"])
+}
@@ -0,0 +1,187 @@
+// Package tagging attaches tags to items so that every item having a tag can be
+// invalidated at once.
+//
+// Each tag has a version counter stored in memcached. Items are stored in an envelope
+// recording the versions of their tags at write time, and an item whose tag versions have
+// changed since is treated as a miss.
+package tagging
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/generation"
+)
+
+// tagKeyPrefix is the prefix of the keys holding the tag versions.
+const tagKeyPrefix = "tag:"
+
+// envelopeMagic is the first byte of every envelope.
+const envelopeMagic = 't'
+
+// ErrCorruptEnvelope means an item does not hold a valid tagging envelope.
+var ErrCorruptEnvelope = errors.New("memcache: corrupt tagging envelope")
+
+// Cache stores tagged items through a memalpha.Conn.
+type Cache struct {
+	conn memalpha.Conn
+	now  func() time.Time
+}
+
+// New creates a Cache over conn.
+func New(conn memalpha.Conn) *Cache {
+	return &Cache{conn: conn, now: time.Now}
+}
+
+func tagKey(tag string) string {
+	return tagKeyPrefix + tag
+}
+
+// versions returns the current versions of tags. If create is true, missing versions are
+// initialized; otherwise they are left out of the result.
+func (c *Cache) versions(tags []string, create bool) (map[string]uint64, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i] = tagKey(tag)
+	}
+
+	m, err := c.conn.Gets(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[string]uint64, len(tags))
+	for _, tag := range tags {
+		if response, ok := m[tagKey(tag)]; ok {
+			version, err := generation.Parse(response.Value)
+			if err != nil {
+				return nil, err
+			}
+			versions[tag] = version
+			continue
+		}
+		if !create {
+			continue
+		}
+
+		version, err := generation.Create(c.conn, tagKey(tag), c.now())
+		if err != nil {
+			return nil, err
+		}
+		versions[tag] = version
+	}
+	return versions, nil
+}
+
+// Set stores value under key, tagged with tags.
+func (c *Cache) Set(key string, value []byte, flags uint32, exptime int, tags ...string) error {
+	versions, err := c.versions(tags, true)
+	if err != nil {
+		return err
+	}
+	return c.conn.Set(key, encodeEnvelope(tags, versions, value), flags, exptime, false)
+}
+
+// Get returns the value of key. It returns memalpha.ErrCacheMiss if key is absent or any
+// of its tags has been invalidated since it was stored.
+func (c *Cache) Get(key string) (value []byte, flags uint32, err error) {
+	data, flags, err := c.conn.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	seen, value, err := decodeEnvelope(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(seen) == 0 {
+		return value, flags, nil
+	}
+
+	tags := make([]string, 0, len(seen))
+	for tag := range seen {
+		tags = append(tags, tag)
+	}
+	current, err := c.versions(tags, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	for tag, version := range seen {
+		if v, ok := current[tag]; !ok || v != version {
+			return nil, 0, memalpha.ErrCacheMiss
+		}
+	}
+	return value, flags, nil
+}
+
+// Invalidate makes every item tagged with any of tags a miss.
+func (c *Cache) Invalidate(tags ...string) error {
+	for _, tag := range tags {
+		_, err := c.conn.Increment(tagKey(tag), 1, false)
+		// A missing version already invalidates the items of the tag.
+		if err != nil && err != memalpha.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeEnvelope serializes tag versions followed by value:
+//
+//	't' <number of tags> (<tag length> <tag> <version>)* <value>
+//
+// All numbers are unsigned varints.
+func encodeEnvelope(tags []string, versions map[string]uint64, value []byte) []byte {
+	buf := make([]byte, 0, 1+binary.MaxVarintLen64+len(value)+len(tags)*(2*binary.MaxVarintLen64+16))
+	buf = append(buf, envelopeMagic)
+	buf = binary.AppendUvarint(buf, uint64(len(tags)))
+	for _, tag := range tags {
+		buf = binary.AppendUvarint(buf, uint64(len(tag)))
+		buf = append(buf, tag...)
+		buf = binary.AppendUvarint(buf, versions[tag])
+	}
+	return append(buf, value...)
+}
+
+func decodeEnvelope(data []byte) (map[string]uint64, []byte, error) {
+	if len(data) == 0 || data[0] != envelopeMagic {
+		return nil, nil, ErrCorruptEnvelope
+	}
+	data = data[1:]
+
+	uvarint := func() (uint64, bool) {
+		n, size := binary.Uvarint(data)
+		if size <= 0 {
+			return 0, false
+		}
+		data = data[size:]
+		return n, true
+	}
+
+	count, ok := uvarint()
+	if !ok || count > uint64(len(data)) {
+		return nil, nil, ErrCorruptEnvelope
+	}
+	versions := make(map[string]uint64, count)
+	for i := uint64(0); i < count; i++ {
+		length, ok := uvarint()
+		if !ok || length > uint64(len(data)) {
+			return nil, nil, ErrCorruptEnvelope
+		}
+		tag := string(data[:length])
+		data = data[length:]
+
+		version, ok := uvarint()
+		if !ok {
+			return nil, nil, ErrCorruptEnvelope
+		}
+		versions[tag] = version
+	}
+	return versions, data, nil
+}
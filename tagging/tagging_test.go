@@ -0,0 +1,80 @@
+package tagging
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+)
+
+func TestTagging(t *testing.T) {
+	backend := memdtest.NewFakeConn()
+	c := New(backend)
+
+	err := c.Set("product:7:page", []byte("page7"), 42, 0, "product:7", "category:3")
+	assert.NoError(t, err)
+	err = c.Set("product:8:page", []byte("page8"), 0, 0, "product:8", "category:3")
+	assert.NoError(t, err)
+	err = c.Set("untagged", []byte("plain"), 0, 0)
+	assert.NoError(t, err)
+
+	value, flags, err := c.Get("product:7:page")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("page7"), value)
+	assert.EqualValues(t, 42, flags)
+
+	err = c.Invalidate("product:7")
+	assert.NoError(t, err)
+	_, _, err = c.Get("product:7:page")
+	assert.Equal(t, memalpha.ErrCacheMiss, err, "invalidated by product:7")
+	value, _, err = c.Get("product:8:page")
+	assert.NoError(t, err, "product:8 is not affected")
+	assert.Equal(t, []byte("page8"), value)
+
+	err = c.Invalidate("category:3")
+	assert.NoError(t, err)
+	_, _, err = c.Get("product:8:page")
+	assert.Equal(t, memalpha.ErrCacheMiss, err, "invalidated by category:3")
+
+	value, _, err = c.Get("untagged")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("plain"), value)
+
+	// Storing again picks up the new versions.
+	err = c.Set("product:8:page", []byte("page8v2"), 0, 0, "product:8", "category:3")
+	assert.NoError(t, err)
+	value, _, err = c.Get("product:8:page")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("page8v2"), value)
+
+	// An evicted tag version invalidates its items.
+	err = backend.Delete(tagKey("product:8"), false)
+	assert.NoError(t, err)
+	_, _, err = c.Get("product:8:page")
+	assert.Equal(t, memalpha.ErrCacheMiss, err, "tag version evicted")
+
+	err = c.Invalidate("unknown")
+	assert.NoError(t, err)
+}
+
+func TestEnvelope(t *testing.T) {
+	tags := []string{"a", "bb"}
+	data := encodeEnvelope(tags, map[string]uint64{"a": 1, "bb": 1 << 40}, []byte("value"))
+
+	versions, value, err := decodeEnvelope(data)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"a": 1, "bb": 1 << 40}, versions)
+	assert.Equal(t, []byte("value"), value)
+
+	for _, corrupt := range [][]byte{nil, []byte("xyz"), data[:3], {envelopeMagic, 0xff}} {
+		_, _, err = decodeEnvelope(corrupt)
+		assert.Equal(t, ErrCorruptEnvelope, err, "decode(%q)", corrupt)
+	}
+
+	backend := memdtest.NewFakeConn()
+	err = backend.Set("raw", []byte("raw"), 0, 0, false)
+	assert.NoError(t, err)
+	_, _, err = New(backend).Get("raw")
+	assert.Equal(t, ErrCorruptEnvelope, err)
+}
@@ -13,6 +13,8 @@ import (
 
 func BenchmarkGetStubSmall(b *testing.B) { benchmarkGetStub(b, 5, 5) }
 func BenchmarkGetStubLarge(b *testing.B) { benchmarkGetStub(b, 250, 1023*1024) }
+func BenchmarkSetStubSmall(b *testing.B) { benchmarkSetStub(b, 5, 5) }
+func BenchmarkSetStubLarge(b *testing.B) { benchmarkSetStub(b, 250, 1023*1024) }
 func BenchmarkGetSmall(b *testing.B)     { benchmarkGet(b, 5, 5) }
 func BenchmarkGetLarge(b *testing.B)     { benchmarkGet(b, 250, 1023*1024) }
 func BenchmarkSetSmall(b *testing.B)     { benchmarkSet(b, 5, 5) }
@@ -48,6 +50,7 @@ func benchmarkGetStub(b *testing.B, keySize int, valueSize int) {
 	}
 
 	b.SetBytes(int64(keySize + valueSize))
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		_, _, err := c.Get(key)
@@ -58,6 +61,28 @@ func benchmarkGetStub(b *testing.B, keySize int, valueSize int) {
 	b.StopTimer()
 }
 
+func benchmarkSetStub(b *testing.B, keySize int, valueSize int) {
+	key := string(bytes.Repeat([]byte("A"), keySize))
+	value := bytes.Repeat([]byte("A"), valueSize)
+
+	c := &TextConn{
+		rw: bufio.NewReadWriter(
+			bufio.NewReader(newRepeatReader([]byte("STORED\r\n"))),
+			bufio.NewWriter(ioutil.Discard),
+		),
+	}
+
+	b.SetBytes(int64(keySize + valueSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.Set(key, value, 0, 0, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+}
+
 func benchmarkGet(b *testing.B, keySize int, valueSize int) {
 	key := string(bytes.Repeat([]byte("A"), keySize))
 	value := bytes.Repeat([]byte("A"), valueSize)
@@ -75,6 +100,7 @@ func benchmarkGet(b *testing.B, keySize int, valueSize int) {
 	}
 
 	b.SetBytes(int64(keySize + valueSize))
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		if _, _, err := memd.Conn.Get(key); err != nil {
@@ -101,6 +127,7 @@ func benchmarkSet(b *testing.B, keySize int, valueSize int) {
 	}
 
 	b.SetBytes(int64(keySize + valueSize))
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		if err := memd.Conn.Set(key, value, 0, 0, false); err != nil {
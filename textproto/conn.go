@@ -6,6 +6,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"strconv"
 	"strings"
@@ -27,21 +28,57 @@ var (
 )
 
 var (
-	responseEnd = []byte("END")
+	responseEnd   = []byte("END")
+	responseValue = []byte("VALUE")
+	responseStat  = []byte("STAT ")
+)
+
+const (
+	// maxLineLength bounds the length of a reply line. Real replies are much shorter.
+	maxLineLength = 64 * 1024
+
+	// preallocLength is the largest value buffer allocated before its data is received.
+	// Larger values grow the buffer as data arrives, so that a hostile <bytes> field
+	// doesn't cause a large allocation.
+	preallocLength = 1024 * 1024
 )
 
 var (
-	bytesCrlf     = []byte("\r\n")
-	bytesVersion  = []byte("VERSION ")
-	optionNoreply = "noreply"
+	bytesCrlf    = []byte("\r\n")
+	bytesVersion = []byte("VERSION ")
+
+	commandVersion = []byte("version\r\n")
+	commandQuit    = []byte("quit\r\n")
 )
 
+// DefaultMaxItemSize is the default largest value accepted from a server, like the
+// default of the -I option of memcached.
+const DefaultMaxItemSize = 1024 * 1024
+
 // TextConn is a memcached connection
 type TextConn struct {
-	Addr    string
+	Addr string
+
+	// MaxItemSize is the largest value buffered from a retrieval response. A larger one
+	// is rejected with a ProtocolError and breaks the connection. Zero means
+	// DefaultMaxItemSize.
+	MaxItemSize int
+
 	netConn net.Conn
 	rw      *bufio.ReadWriter
 	err     error
+
+	// buf is reused to encode command lines, and line to receive reply lines longer than
+	// the read buffer, so that commands don't allocate.
+	buf  []byte
+	line []byte
+
+	// broken is the error which left the connection out of sync with the server. Once
+	// set, every command fails with it.
+	broken error
+
+	// stream is the value being read by the caller of GetReader.
+	stream *valueReader
 }
 
 // Dial connects to the memcached server.
@@ -57,16 +94,24 @@ func DialContext(ctx context.Context, addr string) (*TextConn, error) {
 		return nil, err
 	}
 
-	c := &TextConn{
-		Addr:    addr,
+	c := NewConn(conn)
+	c.Addr = addr
+	return c, nil
+}
+
+// NewConn creates a TextConn over an established connection, such as a wrapped or an
+// in-memory net.Conn.
+func NewConn(conn net.Conn) *TextConn {
+	return &TextConn{
+		Addr:    conn.RemoteAddr().String(),
 		netConn: conn,
 		rw:      bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
 	}
-	return c, nil
 }
 
 // Close a connection.
 func (c *TextConn) Close() error {
+	c.stream = nil
 	if c.netConn == nil {
 		return nil
 	}
@@ -77,42 +122,93 @@ func (c *TextConn) Close() error {
 	return err
 }
 
+// readLine reads a reply line. The line is only valid until the next read.
 func (c *TextConn) readLine() []byte {
 	if c.err != nil {
 		return nil
 	}
 
-	var line, next []byte
-	var isPrefix = true
+	line, isPrefix, err := c.rw.ReadLine()
+	if err != nil {
+		c.fail(err)
+		return nil
+	}
+	if !isPrefix {
+		return line
+	}
 
-	for isPrefix && c.err == nil {
-		next, isPrefix, c.err = c.rw.ReadLine()
-		line = append(line, next...)
+	// The line doesn't fit in the read buffer.
+	c.line = append(c.line[:0], line...)
+	for isPrefix {
+		if line, isPrefix, err = c.rw.ReadLine(); err != nil {
+			c.fail(err)
+			return nil
+		}
+		c.line = append(c.line, line...)
+		if len(c.line) > maxLineLength {
+			c.fail(memalpha.ProtocolError("line too long"))
+			return nil
+		}
 	}
-	return line
+	return c.line
 }
 
 func (c *TextConn) write(p []byte) {
 	if c.err != nil {
 		return
 	}
-	_, c.err = c.rw.Write(p)
+	if c.stream != nil {
+		c.err = ErrBusy
+		return
+	}
+	if _, err := c.rw.Write(p); err != nil {
+		// A part of the command may have been sent.
+		c.fail(err)
+	}
+}
+
+// writeCommand writes a command line encoded into c.buf.
+func (c *TextConn) writeCommand(b []byte) {
+	c.buf = b
+	c.write(b)
 }
 
 func (c *TextConn) flush() {
 	if c.err != nil {
 		return
 	}
-	c.err = c.rw.Flush()
+	if err := c.rw.Flush(); err != nil {
+		c.fail(err)
+	}
 }
 
-// Err results in clearing c.err
+// Err results in clearing c.err, unless the connection is broken.
 func (c *TextConn) Err() error {
 	err := c.err
-	c.err = nil
+	c.err = c.broken
 	return err
 }
 
+// Broken reports whether the connection is out of sync with the server, after which every
+// command fails. memalpha.Pool closes broken connections instead of keeping them.
+func (c *TextConn) Broken() bool {
+	return c.broken != nil
+}
+
+// fail records err, which left the connection out of sync with the server: a reply may
+// be partly unread, or a command partly sent. Every later command fails with err.
+func (c *TextConn) fail(err error) {
+	c.broken = err
+	c.err = err
+}
+
+func (c *TextConn) maxItemSize() uint64 {
+	if c.MaxItemSize <= 0 {
+		return DefaultMaxItemSize
+	}
+	return uint64(c.MaxItemSize)
+}
+
 func (c *TextConn) receiveReply() []byte {
 	if c.err != nil {
 		return nil
@@ -149,100 +245,229 @@ func (c *TextConn) receiveCheckReply() {
 	ok := c.checkReply(reply)
 
 	if c.err == nil && !ok {
-		c.err = memalpha.ProtocolError(fmt.Sprintf("unknown reply type: %s", string(reply)))
+		c.fail(memalpha.ProtocolError(fmt.Sprintf("unknown reply type: %s", string(reply))))
+	}
+}
+
+// appendNoreply terminates a command line, with the noreply option if noreply is true.
+func appendNoreply(b []byte, noreply bool) []byte {
+	if noreply {
+		b = append(b, " noreply"...)
+	} else {
+		b = append(b, ' ')
 	}
+	return append(b, bytesCrlf...)
+}
+
+// parseUint parses a decimal representation of a 64-bit unsigned integer, like
+// strconv.ParseUint(string(b), 10, 64) without allocating.
+func parseUint(b []byte) (uint64, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	var n uint64
+	for _, ch := range b {
+		if ch < '0' || ch > '9' {
+			return 0, false
+		}
+		d := uint64(ch - '0')
+		if n > (math.MaxUint64-d)/10 {
+			return 0, false
+		}
+		n = n*10 + d
+	}
+	return n, true
+}
+
+// legalKey reports whether key can be sent in a command line without breaking the
+// protocol.
+func legalKey(key string) bool {
+	return memalpha.LegalKey(key)
+}
+
+// legalStatsKey reports whether statsKey can be sent in a stats command. It is empty or
+// a list of arguments separated by single spaces, such as "detail on".
+func legalStatsKey(statsKey string) bool {
+	if statsKey == "" {
+		return true
+	}
+	for _, arg := range strings.Split(statsKey, " ") {
+		if !memalpha.LegalKey(arg) {
+			return false
+		}
+	}
+	return true
 }
 
 //// Retrieval commands
 
-func (c *TextConn) sendRetrieveCommand(cmd string, key string) {
-	c.write([]byte(fmt.Sprintf("%s %s\r\n", cmd, key)))
+func (c *TextConn) sendRetrieveCommand(cmd string, keys ...string) {
+	// <cmd> <key>*\r\n
+	b := append(c.buf[:0], cmd...)
+	for _, key := range keys {
+		b = append(b, ' ')
+		b = append(b, key...)
+	}
+	b = append(b, bytesCrlf...)
+	c.writeCommand(b)
 	c.flush()
 }
 
-// returns key, value, casId, flags, err
-func (c *TextConn) receiveGetResponse() (string, *memalpha.Response) {
+// receiveGetResponseHeader receives the header of an item into response, and returns its
+// key and the size of its value, which must not exceed maxSize. The key is only valid
+// until the next read.
+func (c *TextConn) receiveGetResponseHeader(response *memalpha.Response, maxSize uint64) (key []byte, size uint64) {
 	header := c.readLine()
 	if c.err != nil {
-		return "", nil
+		return nil, 0
 	}
 	if bytes.Equal(header, responseEnd) {
 		c.err = memalpha.ErrCacheMiss
-		return "", nil
+		return nil, 0
+	}
+	if c.checkReply(header); c.err != nil {
+		return nil, 0
 	}
 
-	response := &memalpha.Response{}
-	key, size, err := c.parseGetResponseHeader(header, response)
+	key, size, err := parseGetResponseHeader(header, response)
 	if err != nil {
-		c.err = err
-		return "", nil
+		c.fail(err)
+		return nil, 0
 	}
+	if size > maxSize {
+		// The value is left unread, so the connection can't be used any more.
+		c.fail(memalpha.ProtocolError(fmt.Sprintf("value of %d bytes exceeds max item size", size)))
+		return nil, 0
+	}
+	return key, size
+}
 
-	body, err := c.receiveGetResponseBody(size)
-	if err != nil {
-		c.err = err
-		return "", nil
+// receiveGetResponseValue receives the value of an item into response. The value is
+// stored in buf if it is large enough.
+func (c *TextConn) receiveGetResponseValue(response *memalpha.Response, buf []byte, size uint64) {
+	if c.err != nil {
+		return
 	}
-	response.Value = body[:size]
 
-	return key, response
+	value, err := c.receiveGetResponseBody(buf, size)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	response.Value = value
 }
 
-func (c *TextConn) parseGetResponseHeader(header []byte, response *memalpha.Response) (key string, size uint64, err error) {
+func parseGetResponseHeader(header []byte, response *memalpha.Response) (key []byte, size uint64, err error) {
 	// VALUE <key> <flags> <bytes> [<cas unique>]\r\n
-	headerChunks := strings.Split(string(header), " ")
-	debugf("debug header: %+v\n", headerChunks) // output for debug
-	if len(headerChunks) < 4 {
-		return "", 0, memalpha.ProtocolError(fmt.Sprintf("malformed response: %#v", string(header)))
+	var fields [5][]byte
+	n := 0
+	for rest := header; ; n++ {
+		if n == len(fields) {
+			return nil, 0, malformedHeader(header)
+		}
+		i := bytes.IndexByte(rest, ' ')
+		if i < 0 {
+			fields[n] = rest
+			n++
+			break
+		}
+		fields[n] = rest[:i]
+		rest = rest[i+1:]
+	}
+	if n < 4 || !bytes.Equal(fields[0], responseValue) || len(fields[1]) == 0 {
+		return nil, 0, malformedHeader(header)
 	}
 
-	key = headerChunks[1]
+	key = fields[1]
 
-	flags, err := strconv.ParseUint(headerChunks[2], 10, 32)
-	debugf("debug flags: %+v\n", flags) // output for debug
-	if err != nil {
-		return "", 0, err
+	flags, ok := parseUint(fields[2])
+	if !ok || flags > math.MaxUint32 {
+		return nil, 0, malformedHeader(header)
 	}
 	response.Flags = uint32(flags)
 
-	size, err = strconv.ParseUint(headerChunks[3], 10, 64)
-	debugf("debug size: %+v\n", size) // output for debug
-	if err != nil {
-		return "", 0, err
+	size, ok = parseUint(fields[3])
+	if !ok {
+		return nil, 0, malformedHeader(header)
 	}
 
-	if len(headerChunks) == 5 {
-		response.CasID, err = strconv.ParseUint(headerChunks[4], 10, 64)
-		debugf("debug cas: %+v\n", response.CasID) // output for debug
-		if err != nil {
-			return "", 0, err
+	if n == 5 {
+		response.CasID, ok = parseUint(fields[4])
+		if !ok {
+			return nil, 0, malformedHeader(header)
 		}
 	}
 
 	return key, size, nil
 }
 
-func (c *TextConn) receiveGetResponseBody(size uint64) ([]byte, error) {
-	buffer := make([]byte, size+2)
-	n, err := io.ReadFull(c.rw, buffer)
-	debugf("debug n: %+v\n", n) // output for debug
-	if err != nil {
-		return nil, err
-	}
+func malformedHeader(header []byte) error {
+	return memalpha.ProtocolError(fmt.Sprintf("malformed response: %#v", string(header)))
+}
 
-	// Check \r\n
-	if !bytes.HasSuffix(buffer, bytesCrlf) {
-		return nil, memalpha.ProtocolError("malformed response: corrupt get result end")
+// receiveGetResponseBody receives a data block of size bytes into buf, which is
+// reallocated if it is too small.
+func (c *TextConn) receiveGetResponseBody(buf []byte, size uint64) ([]byte, error) {
+	if uint64(cap(buf)) >= size || size <= preallocLength {
+		if uint64(cap(buf)) < size {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		n, err := io.ReadFull(c.rw, buf)
+		debugf("debug n: %+v\n", n) // output for debug
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		b := bytes.NewBuffer(buf[:0])
+		b.Grow(preallocLength)
+		n, err := io.CopyN(b, c.rw, int64(size))
+		debugf("debug n: %+v\n", n) // output for debug
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf = b.Bytes()
 	}
 
-	return buffer, nil
+	return buf, c.receiveGetResponseBodyEnd()
+}
+
+// receiveGetResponseBodyEnd receives the \r\n terminating a data block.
+func (c *TextConn) receiveGetResponseBodyEnd() error {
+	crlf, err := c.rw.Peek(len(bytesCrlf))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(crlf, bytesCrlf) {
+		return memalpha.ProtocolError("malformed response: corrupt get result end")
+	}
+	_, err = c.rw.Discard(len(bytesCrlf))
+	return err
 }
 
 // Get returns a value, flags and error.
 func (c *TextConn) Get(key string) (value []byte, flags uint32, err error) {
+	return c.GetInto(key, nil)
+}
+
+// GetInto is like Get, but stores the value in buf if it is large enough. Otherwise, the
+// value is stored in newly allocated memory, like append does.
+func (c *TextConn) GetInto(key string, buf []byte) (value []byte, flags uint32, err error) {
+	if !legalKey(key) {
+		return nil, 0, memalpha.ErrMalformedKey
+	}
+
 	c.sendRetrieveCommand("get", key)
 
-	_, response := c.receiveGetResponse()
+	var response memalpha.Response
+	_, size := c.receiveGetResponseHeader(&response, c.maxItemSize())
+	c.receiveGetResponseValue(&response, buf, size)
 
 	// Confirm END
 	endLine := c.readLine()
@@ -250,7 +475,8 @@ func (c *TextConn) Get(key string) (value []byte, flags uint32, err error) {
 		return nil, 0, err
 	}
 	if !bytes.Equal(endLine, responseEnd) {
-		return nil, 0, memalpha.ProtocolError("malformed response: corrupt get result end")
+		c.fail(memalpha.ProtocolError("malformed response: corrupt get result end"))
+		return nil, 0, c.Err()
 	}
 
 	return response.Value, response.Flags, nil
@@ -258,18 +484,30 @@ func (c *TextConn) Get(key string) (value []byte, flags uint32, err error) {
 
 // Gets is an alternative get command for using with CAS.
 func (c *TextConn) Gets(keys []string) (map[string]*memalpha.Response, error) {
-	c.sendRetrieveCommand("gets", strings.Join(keys, " "))
+	if len(keys) == 0 {
+		return nil, memalpha.ErrMalformedKey
+	}
+	for _, key := range keys {
+		if !legalKey(key) {
+			return nil, memalpha.ErrMalformedKey
+		}
+	}
+
+	c.sendRetrieveCommand("gets", keys...)
 
 	m := make(map[string]*memalpha.Response)
 	for {
-		key, response := c.receiveGetResponse()
+		response := &memalpha.Response{}
+		key, size := c.receiveGetResponseHeader(response, c.maxItemSize())
+		k := string(key)
+		c.receiveGetResponseValue(response, nil, size)
 		if err := c.Err(); err != nil {
 			if err == memalpha.ErrCacheMiss {
 				break
 			}
 			return nil, err
 		}
-		m[key] = response
+		m[k] = response
 	}
 
 	return m, nil
@@ -278,18 +516,11 @@ func (c *TextConn) Gets(keys []string) (map[string]*memalpha.Response, error) {
 //// Storage commands
 
 func (c *TextConn) sendStorageCommand(command string, key string, value []byte, flags uint32, exptime int, casid uint64, noreply bool) error {
-	option := ""
-	if noreply {
-		option = "noreply"
+	if !legalKey(key) {
+		return memalpha.ErrMalformedKey
 	}
 
-	if command == "cas" {
-		// Send command: cas       <key> <flags> <exptime> <bytes> <cas unique> [noreply]\r\n
-		c.write([]byte(fmt.Sprintf("%s %s %d %d %d %d %s\r\n", command, key, flags, exptime, len(value), casid, option)))
-	} else {
-		// Send command: <command> <key> <flags> <exptime> <bytes> [noreply]\r\n
-		c.write([]byte(fmt.Sprintf("%s %s %d %d %d %s\r\n", command, key, flags, exptime, len(value), option)))
-	}
+	c.writeStorageCommand(command, key, len(value), flags, exptime, casid, noreply)
 
 	// Send data block: <data block>\r\n
 	c.write(value)
@@ -303,6 +534,25 @@ func (c *TextConn) sendStorageCommand(command string, key string, value []byte,
 	return c.Err()
 }
 
+func (c *TextConn) writeStorageCommand(command string, key string, size int, flags uint32, exptime int, casid uint64, noreply bool) {
+	// Send command: <command> <key> <flags> <exptime> <bytes> [noreply]\r\n
+	//              cas       <key> <flags> <exptime> <bytes> <cas unique> [noreply]\r\n
+	b := append(c.buf[:0], command...)
+	b = append(b, ' ')
+	b = append(b, key...)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, uint64(flags), 10)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(exptime), 10)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(size), 10)
+	if command == "cas" {
+		b = append(b, ' ')
+		b = strconv.AppendUint(b, casid, 10)
+	}
+	c.writeCommand(appendNoreply(b, noreply))
+}
+
 // Set means "store this data".
 func (c *TextConn) Set(key string, value []byte, flags uint32, exptime int, noreply bool) error {
 	return c.sendStorageCommand("set", key, value, flags, exptime, 0, noreply)
@@ -342,13 +592,14 @@ func (c *TextConn) CompareAndSwap(key string, value []byte, casid uint64, flags
 
 // Delete deletes the item with the provided key
 func (c *TextConn) Delete(key string, noreply bool) error {
-	option := ""
-	if noreply {
-		option = optionNoreply
+	if !legalKey(key) {
+		return memalpha.ErrMalformedKey
 	}
 
 	// delete <key> [noreply]\r\n
-	c.write([]byte(fmt.Sprintf("delete %s %s\r\n", key, option)))
+	b := append(c.buf[:0], "delete "...)
+	b = append(b, key...)
+	c.writeCommand(appendNoreply(b, noreply))
 	c.flush()
 
 	if !noreply {
@@ -379,13 +630,17 @@ func (c *TextConn) Decrement(key string, value uint64, noreply bool) (uint64, er
 }
 
 func (c *TextConn) executeIncrDecrCommand(command string, key string, value uint64, noreply bool) (uint64, error) {
-	option := ""
-	if noreply {
-		option = optionNoreply
+	if !legalKey(key) {
+		return 0, memalpha.ErrMalformedKey
 	}
 
 	// <incr|decr> <key> <value> [noreply]\r\n
-	c.write([]byte(fmt.Sprintf("%s %s %d %s\r\n", command, key, value, option)))
+	b := append(c.buf[:0], command...)
+	b = append(b, ' ')
+	b = append(b, key...)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, value, 10)
+	c.writeCommand(appendNoreply(b, noreply))
 	c.flush()
 
 	if noreply {
@@ -400,9 +655,10 @@ func (c *TextConn) executeIncrDecrCommand(command string, key string, value uint
 	}
 
 	// Calculate a new value from reply.
-	newValue, err := strconv.ParseUint(string(reply), 10, 64)
-	if err != nil {
-		return 0, err
+	newValue, ok := parseUint(reply)
+	if !ok {
+		c.fail(memalpha.ProtocolError(fmt.Sprintf("unknown reply type: %s", string(reply))))
+		return 0, c.Err()
 	}
 	return newValue, nil
 }
@@ -411,13 +667,16 @@ func (c *TextConn) executeIncrDecrCommand(command string, key string, value uint
 
 // Touch is used to update the expiration time of an existing item without fetching it.
 func (c *TextConn) Touch(key string, exptime int32, noreply bool) error {
-	option := ""
-	if noreply {
-		option = "noreply"
+	if !legalKey(key) {
+		return memalpha.ErrMalformedKey
 	}
 
 	// touch <key> <exptime> [noreply]\r\n
-	c.write([]byte(fmt.Sprintf("touch %s %d %s\r\n", key, exptime, option)))
+	b := append(c.buf[:0], "touch "...)
+	b = append(b, key...)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(exptime), 10)
+	c.writeCommand(appendNoreply(b, noreply))
 	c.flush()
 
 	if noreply {
@@ -440,9 +699,15 @@ func (c *TextConn) Touch(key string, exptime int32, noreply bool) error {
 // server. When the key is an empty string, the server will respond with a "default" set
 // of statistics information.
 func (c *TextConn) Stats(statsKey string) (map[string]string, error) {
-	// Send command: stats\r\n
-	command := []byte(fmt.Sprintf("stats %s\r\n", statsKey))
-	c.write(command)
+	if !legalStatsKey(statsKey) {
+		return nil, memalpha.ErrMalformedKey
+	}
+
+	// Send command: stats [<key>]\r\n
+	b := append(c.buf[:0], "stats "...)
+	b = append(b, statsKey...)
+	b = append(b, bytesCrlf...)
+	c.writeCommand(b)
 	c.flush()
 
 	m := make(map[string]string)
@@ -454,12 +719,19 @@ func (c *TextConn) Stats(statsKey string) (map[string]string, error) {
 		if bytes.Equal(line, responseEnd) {
 			return m, nil
 		}
-		if !bytes.HasPrefix(line, []byte("STAT ")) {
-			return nil, memalpha.ProtocolError("malformed stats response")
+		if !bytes.HasPrefix(line, responseStat) {
+			c.fail(memalpha.ProtocolError("malformed stats response"))
+			return nil, c.Err()
 		}
 
-		data := bytes.SplitN(line[5:], []byte(" "), 3)
-		m[string(data[0])] = string(data[1])
+		// STAT <name> <value>
+		line = line[len(responseStat):]
+		i := bytes.IndexByte(line, ' ')
+		if i <= 0 {
+			c.fail(memalpha.ProtocolError("malformed stats response"))
+			return nil, c.Err()
+		}
+		m[string(line[:i])] = string(line[i+1:])
 	}
 }
 
@@ -468,17 +740,13 @@ func (c *TextConn) Stats(statsKey string) (map[string]string, error) {
 // FlushAll invalidates all existing items immediately (by default) or after the delay
 // specified. If delay is < 0, it ignores the delay.
 func (c *TextConn) FlushAll(delay int, noreply bool) error {
-	option := ""
-	if noreply {
-		option = optionNoreply
-	}
-
 	// flush_all [delay] [noreply]\r\n
+	b := append(c.buf[:0], "flush_all"...)
 	if delay >= 0 {
-		c.write([]byte(fmt.Sprintf("flush_all %d %s\r\n", delay, option)))
-	} else {
-		c.write([]byte(fmt.Sprintf("flush_all %s\r\n", option)))
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, int64(delay), 10)
 	}
+	c.writeCommand(appendNoreply(b, noreply))
 	c.flush()
 
 	if noreply {
@@ -494,7 +762,7 @@ func (c *TextConn) FlushAll(delay int, noreply bool) error {
 func (c *TextConn) Version() (string, error) {
 	// version\r\n
 	// NOTE: noreply option is not allowed.
-	c.write([]byte("version\r\n"))
+	c.write(commandVersion)
 	c.flush()
 
 	// Receive reply
@@ -508,14 +776,15 @@ func (c *TextConn) Version() (string, error) {
 		// "VERSION " is 8 chars.
 		return string(reply[len(bytesVersion):]), nil
 	}
-	return "", memalpha.ProtocolError(fmt.Sprintf("unknown reply type: %s", string(reply)))
+	c.fail(memalpha.ProtocolError(fmt.Sprintf("unknown reply type: %s", string(reply))))
+	return "", c.Err()
 }
 
 // Quit closes the connection to memcached server
 func (c *TextConn) Quit() error {
 	// quit\r\n
 	// NOTE: noreply option is not allowed.
-	c.write([]byte("quit\r\n"))
+	c.write(commandQuit)
 	c.flush()
 	return c.Err()
 }
@@ -3,16 +3,18 @@ package textproto
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
-	"strconv"
+	"os"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/transcript"
 )
 
 type errorWriter struct{ error }
@@ -93,7 +95,7 @@ func TestMalformedGetResponse(t *testing.T) {
 		// Malformed CasID
 		c := newFakedConn("VALUE foo 0 6 foo\r\nfoobar\r\nEND", ioutil.Discard)
 		_, _, err := c.Get("foo")
-		assert.IsType(t, &strconv.NumError{}, err)
+		assert.IsType(t, memalpha.ProtocolError(""), err)
 	}
 
 	{
@@ -107,14 +109,28 @@ func TestMalformedGetResponse(t *testing.T) {
 		// Got malformed flags
 		c := newFakedConn("VALUE foo foo 4\r\nfoobar\r\nEND", ioutil.Discard)
 		_, _, err := c.Get("foo")
-		assert.IsType(t, &strconv.NumError{}, err)
+		assert.IsType(t, memalpha.ProtocolError(""), err)
 	}
 
 	{
 		// Got malformed value size
 		c := newFakedConn("VALUE foo 0 foo\r\nfoobar\r\nEND", ioutil.Discard)
 		_, _, err := c.Get("foo")
-		assert.IsType(t, &strconv.NumError{}, err)
+		assert.IsType(t, memalpha.ProtocolError(""), err)
+	}
+
+	{
+		// Got a hostile value size
+		c := newFakedConn("VALUE foo 0 18446744073709551615\r\nfoobar\r\nEND", ioutil.Discard)
+		_, _, err := c.Get("foo")
+		assert.IsType(t, memalpha.ProtocolError(""), err)
+	}
+
+	{
+		// Got an error reply
+		c := newFakedConn("SERVER_ERROR out of memory", ioutil.Discard)
+		_, _, err := c.Get("foo")
+		assert.Equal(t, memalpha.ServerError("out of memory"), err)
 	}
 
 	{
@@ -132,6 +148,52 @@ func TestMalformedGetResponse(t *testing.T) {
 	}
 }
 
+func TestMaxItemSize(t *testing.T) {
+	{
+		c := newFakedConn(fmt.Sprintf("VALUE foo 0 %d\r\n", DefaultMaxItemSize+1), ioutil.Discard)
+		_, _, err := c.Get("foo")
+		assert.IsType(t, memalpha.ProtocolError(""), err)
+
+		// The connection is broken.
+		assert.Equal(t, err, c.Set("foo", []byte("bar"), 0, 0, false))
+		_, _, err2 := c.Get("foo")
+		assert.Equal(t, err, err2)
+	}
+
+	{
+		c := newFakedConn("VALUE foo 0 6\r\nfoobar\r\nEND\r\nVALUE foo 0 6\r\nfoobar\r\nEND\r\n", ioutil.Discard)
+		value, _, err := c.Get("foo")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("foobar"), value)
+
+		c.MaxItemSize = 5
+		_, err = c.Gets([]string{"foo"})
+		assert.Equal(t, memalpha.ProtocolError("value of 6 bytes exceeds max item size"), err)
+	}
+}
+
+func TestBrokenConnection(t *testing.T) {
+	for _, response := range []string{
+		"VALUE foo 0 4\r\nfoobar\r\nEND\r\n",  // corrupt data block end
+		"VALUE foo 0\r\nfoobar\r\nEND\r\n",    // malformed header
+		"VALUE foo 0 3\r\nbar\r\nNOT_END\r\n", // corrupt get result end
+		"VALUE foo 0 6\r\nfoo",                // truncated value
+	} {
+		c := newFakedConn(response+"STORED\r\n", ioutil.Discard)
+		_, _, err := c.Get("foo")
+		assert.Error(t, err, "%q", response)
+
+		// The rest of the response is still on the wire, so the connection is broken.
+		assert.Equal(t, err, c.Set("foo", []byte("bar"), 0, 0, false), "%q", response)
+	}
+
+	// Error replies leave the connection usable.
+	c := newFakedConn("SERVER_ERROR out of memory\r\nSTORED\r\n", ioutil.Discard)
+	_, _, err := c.Get("foo")
+	assert.Equal(t, memalpha.ServerError("out of memory"), err)
+	assert.NoError(t, c.Set("foo", []byte("bar"), 0, 0, false))
+}
+
 func TestMalformedSetResponse(t *testing.T) {
 	c := newFakedConn("foobar", ioutil.Discard)
 	err := c.Set("foo", []byte("bar"), 0, 0, false)
@@ -145,6 +207,12 @@ func TestMalformedStatsResponse(t *testing.T) {
 		assert.Equal(t, memalpha.ProtocolError("malformed stats response"), err)
 	}
 
+	{
+		c := newFakedConn("STAT foo\r\nEND", ioutil.Discard)
+		_, err := c.Stats("")
+		assert.Equal(t, memalpha.ProtocolError("malformed stats response"), err)
+	}
+
 	{
 		expected := net.UnknownNetworkError("test")
 		c := newFakedConn("foobar", errorWriter{expected})
@@ -158,7 +226,7 @@ func TestIncrValueError(t *testing.T) {
 
 	err := c.Set("foo", []byte("42"), 0, 0, true)
 	_, err = c.Increment("foo", 1, false)
-	assert.IsType(t, &strconv.NumError{}, err)
+	assert.IsType(t, memalpha.ProtocolError(""), err)
 }
 
 func TestMalformedVersionResponse(t *testing.T) {
@@ -174,3 +242,223 @@ func TestMalformedVersionResponse(t *testing.T) {
 		assert.Equal(t, memalpha.ErrReplyError, err)
 	}
 }
+
+func TestMalformedKey(t *testing.T) {
+	malformedKeys := []string{
+		"",
+		"a\r\nflush_all",
+		"foo bar",
+		"tab\t",
+		"nul\x00",
+		"del\x7f",
+		strings.Repeat("A", 251),
+	}
+
+	for _, key := range malformedKeys {
+		var request bytes.Buffer
+		c := newFakedConn("STORED\r\n", &request)
+
+		_, _, err := c.Get(key)
+		assert.Equal(t, memalpha.ErrMalformedKey, err, "get(%q)", key)
+		_, err = c.Gets([]string{"foo", key})
+		assert.Equal(t, memalpha.ErrMalformedKey, err, "gets(foo, %q)", key)
+		err = c.Set(key, []byte("bar"), 0, 0, false)
+		assert.Equal(t, memalpha.ErrMalformedKey, err, "set(%q)", key)
+		err = c.Add(key, []byte("bar"), 0, 0, false)
+		assert.Equal(t, memalpha.ErrMalformedKey, err, "add(%q)", key)
+		err = c.Replace(key, []byte("bar"), 0, 0, false)
+		assert.Equal(t, memalpha.ErrMalformedKey, err, "replace(%q)", key)
+		err = c.Append(key, []byte("bar"), false)
+		assert.Equal(t, memalpha.ErrMalformedKey, err, "append(%q)", key)
+		err = c.Prepend(key, []byte("bar"), false)
+		assert.Equal(t, memalpha.ErrMalformedKey, err, "prepend(%q)", key)
+		err = c.CompareAndSwap(key, []byte("bar"), 1, 0, 0, false)
+		assert.Equal(t, memalpha.ErrMalformedKey, err, "cas(%q)", key)
+		err = c.Delete(key, false)
+		assert.Equal(t, memalpha.ErrMalformedKey, err, "delete(%q)", key)
+		_, err = c.Increment(key, 1, false)
+		assert.Equal(t, memalpha.ErrMalformedKey, err, "incr(%q)", key)
+		_, err = c.Decrement(key, 1, false)
+		assert.Equal(t, memalpha.ErrMalformedKey, err, "decr(%q)", key)
+		err = c.Touch(key, 0, false)
+		assert.Equal(t, memalpha.ErrMalformedKey, err, "touch(%q)", key)
+
+		assert.Empty(t, request.String(), "no command is sent for %q", key)
+
+		// The connection is still usable.
+		err = c.Set("foo", []byte("bar"), 0, 0, false)
+		assert.NoError(t, err, "set(foo) after %q", key)
+	}
+
+	{
+		var request bytes.Buffer
+		c := newFakedConn("", &request)
+		_, err := c.Gets(nil)
+		assert.Equal(t, memalpha.ErrMalformedKey, err, "gets()")
+		assert.Empty(t, request.String())
+	}
+
+	{
+		// The longest legal key is accepted.
+		c := newFakedConn("STORED\r\n", ioutil.Discard)
+		err := c.Set(strings.Repeat("A", 250), []byte("bar"), 0, 0, false)
+		assert.NoError(t, err)
+	}
+}
+
+func TestReplaySession(t *testing.T) {
+	f, err := os.Open("testdata/session.transcript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	script, err := transcript.Read(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := transcript.NewReplayer(script)
+	c := NewConn(r.Conn())
+
+	assert.NoError(t, c.Set("foo", []byte("bar"), 42, 0, false))
+	m, err := c.Gets([]string{"foo", "missing"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]*memalpha.Response{"foo": {Value: []byte("bar"), Flags: 42, CasID: 7}}, m)
+	assert.NoError(t, c.CompareAndSwap("foo", []byte("baz"), 7, 0, 0, false))
+	assert.Equal(t, memalpha.ErrCasConflict, c.CompareAndSwap("foo", []byte("qux"), 7, 0, 0, false))
+	assert.NoError(t, c.Delete("foo", false))
+	_, _, err = c.Get("foo")
+	assert.Equal(t, memalpha.ErrCacheMiss, err)
+	version, err := c.Version()
+	assert.NoError(t, err)
+	assert.Equal(t, "1.6.21", version)
+
+	assert.NoError(t, c.Close())
+	assert.NoError(t, r.Wait())
+}
+
+func TestAllocs(t *testing.T) {
+	c := &TextConn{rw: bufio.NewReadWriter(
+		bufio.NewReader(newRepeatReader([]byte("VALUE foo 42 3\r\nbar\r\nEND\r\nSTORED\r\n43\r\n"))),
+		bufio.NewWriter(ioutil.Discard),
+	)}
+	value := []byte("bar")
+
+	// Only the value returned by Get is allocated.
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, _, err := c.Get("foo"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Set("foo", value, 42, 0, false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Increment("foo", 1, false); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Equal(t, 1.0, allocs)
+}
+
+func TestGetInto(t *testing.T) {
+	c := newFakedConn("VALUE foo 42 3\r\nbar\r\nEND\r\nVALUE foo 0 6\r\nfoobar\r\nEND\r\n", ioutil.Discard)
+	buf := make([]byte, 0, 4)
+
+	value, flags, err := c.GetInto("foo", buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), value)
+	assert.EqualValues(t, 42, flags)
+	assert.True(t, &value[0] == &buf[:1][0], "the value is stored in buf")
+
+	value, _, err = c.GetInto("foo", buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("foobar"), value)
+}
+
+func TestGetReader(t *testing.T) {
+	var request bytes.Buffer
+	c := newFakedConn("VALUE foo 42 6\r\nfoobar\r\nEND\r\nVALUE foo 0 6\r\nfoobar\r\nEND\r\nVALUE foo 0 0\r\n\r\nEND\r\nEND\r\n", &request)
+
+	r, size, flags, err := c.GetReader("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, 6, size)
+	assert.EqualValues(t, 42, flags)
+	assert.Equal(t, ErrBusy, c.Set("foo", []byte("bar"), 0, 0, false))
+	value, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("foobar"), value)
+	assert.NoError(t, r.Close())
+
+	// Closing skips the rest of the value.
+	r, _, _, err = c.GetReader("foo")
+	assert.NoError(t, err)
+	p := make([]byte, 3)
+	_, err = io.ReadFull(r, p)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	_, err = r.Read(p)
+	assert.Equal(t, io.EOF, err)
+
+	r, size, _, err = c.GetReader("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, size)
+	value, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Empty(t, value)
+
+	_, _, _, err = c.GetReader("foo")
+	assert.Equal(t, memalpha.ErrCacheMiss, err)
+	assert.Equal(t, "get foo\r\nget foo\r\nget foo\r\nget foo\r\n", request.String())
+
+	// Streamed values aren't limited by MaxItemSize.
+	c = newFakedConn("VALUE foo 0 6\r\nfoobar\r\nEND\r\nSTORED\r\n", ioutil.Discard)
+	c.MaxItemSize = 5
+	r, size, _, err = c.GetReader("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, 6, size)
+	value, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("foobar"), value)
+	assert.NoError(t, c.Set("foo", []byte("bar"), 0, 0, false), "the connection is still usable")
+
+	// A truncated value breaks the connection.
+	c = newFakedConn("VALUE foo 0 6\r\nfoo", ioutil.Discard)
+	r, _, _, err = c.GetReader("foo")
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, _, err = c.Get("foo")
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestSetFrom(t *testing.T) {
+	var request bytes.Buffer
+	c := newFakedConn("STORED\r\n", &request)
+
+	assert.NoError(t, c.SetFrom("foo", strings.NewReader("foobar"), 6, 42, 0, false))
+	assert.NoError(t, c.SetFrom("foo", strings.NewReader("foobar"), 3, 0, 0, true))
+	assert.Equal(t, "set foo 42 0 6 \r\nfoobar\r\nset foo 0 0 3 noreply\r\nfoo\r\n", request.String())
+
+	// A short reader of a small value fails before anything is sent.
+	request.Reset()
+	c = newFakedConn("STORED\r\n", &request)
+	err := c.SetFrom("foo", strings.NewReader("foo"), 6, 0, 0, false)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Empty(t, request.String())
+	assert.False(t, c.Broken())
+	assert.NoError(t, c.Set("foo", []byte("bar"), 0, 0, false))
+
+	// A short reader of a streamed value breaks the connection.
+	err = c.SetFrom("foo", strings.NewReader("foo"), setFromBufferSize+1, 0, 0, false)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.True(t, c.Broken())
+	assert.Equal(t, io.ErrUnexpectedEOF, c.Set("foo", []byte("bar"), 0, 0, false))
+
+	// The pool closes it instead of keeping it.
+	pool := memalpha.NewPool(func(context.Context) (memalpha.Conn, error) {
+		return newFakedConn("", ioutil.Discard), nil
+	}, 1)
+	assert.NoError(t, pool.Put(c))
+	pooled, err := pool.Get()
+	assert.NoError(t, err)
+	assert.True(t, pooled != memalpha.Conn(c), "a new connection is dialed")
+}
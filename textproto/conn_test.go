@@ -10,6 +10,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/conntest"
 	"github.com/ttakezawa/memalpha/internal/memdtest"
 )
 
@@ -242,6 +243,8 @@ func TestLocalhost(t *testing.T) {
 	if len(stats) < 2 {
 		t.Fatalf("stats(slabs): len(Value) = %q, want len(value) > 2", stats)
 	}
+	_, err = c.Stats("\r\nflush_all")
+	assert.Equal(t, memalpha.ErrMalformedKey, err, "stats(\\r\\nflush_all)")
 
 	// FlushAll
 	mustSet("foo", []byte("bar"))
@@ -290,3 +293,50 @@ func TestLocalhost(t *testing.T) {
 	err = c.Close()
 	assert.NoError(t, err, "retry c.Close()")
 }
+
+func TestStream(t *testing.T) {
+	memd := memdtest.NewServer(func(addr string) (memalpha.Conn, error) {
+		return Dial(addr)
+	})
+	err := memd.Start()
+	if err != nil {
+		t.Skipf("skipping test; couldn't start memcached: %s", err)
+	}
+	defer func() { _ = memd.Shutdown() }()
+
+	c := memd.Conn.(*TextConn)
+	largeValue := bytes.Repeat([]byte("0123456789"), 100*1024)
+
+	err = c.SetFrom("large", bytes.NewReader(largeValue), len(largeValue), 42, 0, false)
+	assert.NoError(t, err)
+
+	r, size, flags, err := c.GetReader("large")
+	if assert.NoError(t, err) {
+		assert.Equal(t, len(largeValue), size)
+		assert.EqualValues(t, 42, flags)
+		var b bytes.Buffer
+		_, err = b.ReadFrom(r)
+		assert.NoError(t, err)
+		assert.Equal(t, largeValue, b.Bytes())
+		assert.NoError(t, r.Close())
+	}
+
+	value, _, err := c.GetInto("large", make([]byte, 0, len(largeValue)))
+	assert.NoError(t, err)
+	assert.Equal(t, largeValue, value)
+}
+
+func TestConformance(t *testing.T) {
+	memd := memdtest.NewServer(func(addr string) (memalpha.Conn, error) {
+		return Dial(addr)
+	})
+	err := memd.Start()
+	if err != nil {
+		t.Skipf("skipping test; couldn't start memcached: %s", err)
+	}
+	defer func() { _ = memd.Shutdown() }()
+
+	conntest.Run(t, func() (memalpha.Conn, error) {
+		return Dial(memd.Addr)
+	})
+}
@@ -0,0 +1,115 @@
+package textproto
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+// checkFuzzError fails unless err is one a caller can expect from a malformed or failed
+// reply.
+func checkFuzzError(t *testing.T, response string, err error) {
+	switch err.(type) {
+	case nil, memalpha.ProtocolError, memalpha.ClientError, memalpha.ServerError:
+		return
+	}
+	switch err {
+	case memalpha.ErrCacheMiss, memalpha.ErrNotFound, memalpha.ErrCasConflict, memalpha.ErrNotStored, memalpha.ErrReplyError, io.EOF, io.ErrUnexpectedEOF:
+		return
+	}
+	t.Errorf("response %q: unexpected error %#v", response, err)
+}
+
+var fuzzSeeds = []string{
+	"",
+	"END\r\n",
+	"VALUE foo 0 3\r\nbar\r\nEND\r\n",
+	"VALUE foo 42 3 7\r\nbar\r\nVALUE baz 0 0 8\r\n\r\nEND\r\n",
+	"VALUE foo 0 18446744073709551615\r\nbar\r\nEND\r\n",
+	"VALUE foo\r\n",
+	"STAT pid 1\r\nSTAT version 1.4.25\r\nEND\r\n",
+	"STAT foo\r\nEND\r\n",
+	"STORED\r\n",
+	"NOT_STORED\r\n",
+	"EXISTS\r\n",
+	"NOT_FOUND\r\n",
+	"DELETED\r\n",
+	"TOUCHED\r\n",
+	"OK\r\n",
+	"ERROR\r\n",
+	"CLIENT_ERROR bad command line format\r\n",
+	"SERVER_ERROR out of memory\r\n",
+	"43\r\n",
+	"-1\r\n",
+	"VERSION 1.4.25\r\n",
+}
+
+func fuzzConn(f *testing.F, fn func(c *TextConn) error) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, response string) {
+		checkFuzzError(t, response, fn(newFakedConn(response, ioutil.Discard)))
+	})
+}
+
+func FuzzGet(f *testing.F) {
+	fuzzConn(f, func(c *TextConn) error {
+		_, _, err := c.Get("foo")
+		return err
+	})
+}
+
+func FuzzGets(f *testing.F) {
+	fuzzConn(f, func(c *TextConn) error {
+		_, err := c.Gets([]string{"foo", "baz"})
+		return err
+	})
+}
+
+func FuzzStorage(f *testing.F) {
+	fuzzConn(f, func(c *TextConn) error {
+		return c.CompareAndSwap("foo", []byte("bar"), 7, 0, 0, false)
+	})
+}
+
+func FuzzDelete(f *testing.F) {
+	fuzzConn(f, func(c *TextConn) error {
+		return c.Delete("foo", false)
+	})
+}
+
+func FuzzIncrement(f *testing.F) {
+	fuzzConn(f, func(c *TextConn) error {
+		_, err := c.Increment("foo", 1, false)
+		return err
+	})
+}
+
+func FuzzTouch(f *testing.F) {
+	fuzzConn(f, func(c *TextConn) error {
+		return c.Touch("foo", 0, false)
+	})
+}
+
+func FuzzStats(f *testing.F) {
+	fuzzConn(f, func(c *TextConn) error {
+		_, err := c.Stats("")
+		return err
+	})
+}
+
+func FuzzFlushAll(f *testing.F) {
+	fuzzConn(f, func(c *TextConn) error {
+		return c.FlushAll(0, false)
+	})
+}
+
+func FuzzVersion(f *testing.F) {
+	fuzzConn(f, func(c *TextConn) error {
+		_, err := c.Version()
+		return err
+	})
+}
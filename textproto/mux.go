@@ -0,0 +1,844 @@
+package textproto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+var errMuxClosed = errors.New("memcache: use of closed connection")
+
+var (
+	replyMetaValue    = []byte("VA")
+	replyMetaHeader   = []byte("HD")
+	replyMetaMiss     = []byte("EN")
+	replyMetaNotFound = []byte("NF")
+	replyMetaNotStore = []byte("NS")
+	replyMetaExists   = []byte("EX")
+	replyMetaNoop     = []byte("MN")
+
+	commandMetaNoop = []byte("mn\r\n")
+)
+
+// MuxConn is a memcached connection safe for concurrent use. It multiplexes the commands
+// of many goroutines over a few sockets with the meta protocol of memcached 1.6: each
+// command is tagged with an opaque token, and its reply is routed back to the waiting
+// goroutine by the token, so commands are pipelined instead of waiting for each other.
+//
+// Commands on the same key go to the same socket, so they take effect in order, even
+// noreply ones. FlushAll and Quit are sent on every socket.
+//
+// Stats, FlushAll, Version and Quit have no meta version. Their replies, and errors
+// replied without a token such as CLIENT_ERROR, go to the oldest command waiting on the
+// socket, since memcached answers in order. A noreply command is followed by a mn
+// command, so that it waits on the socket until the MN reply and takes its own errors.
+//
+// A socket failing fails the commands waiting on it, and it is no longer used: its keys
+// go to the other sockets. Failed sockets are not redialed, so once every socket failed,
+// every command fails and the caller must dial a new MuxConn.
+type MuxConn struct {
+	Addr string
+
+	// MaxItemSize is the largest value accepted in a reply, like TextConn.MaxItemSize, but
+	// a larger value only fails its command. It must be set before use.
+	MaxItemSize int
+
+	sockets []*muxSocket
+	next    uint32
+}
+
+const (
+	offset32 = 2166136261
+	prime32  = 16777619
+)
+
+// keyHash returns the FNV-1a hash of key.
+func keyHash(key string) uint32 {
+	h := uint32(offset32)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= prime32
+	}
+	return h
+}
+
+// DialMux connects to the memcached server with n sockets.
+func DialMux(addr string, n int) (*MuxConn, error) {
+	return DialMuxContext(context.Background(), addr, n)
+}
+
+// DialMuxContext connects to the memcached server with n sockets using the provided
+// context.
+func DialMuxContext(ctx context.Context, addr string, n int) (*MuxConn, error) {
+	var d net.Dialer
+	conns := make([]net.Conn, 0, n)
+	for i := 0; i < n; i++ {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			for _, conn := range conns {
+				_ = conn.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+
+	c := NewMuxConn(conns...)
+	c.Addr = addr
+	return c, nil
+}
+
+// NewMuxConn creates a MuxConn over established connections to the same server.
+func NewMuxConn(conns ...net.Conn) *MuxConn {
+	c := &MuxConn{}
+	if len(conns) > 0 {
+		c.Addr = conns[0].RemoteAddr().String()
+	}
+	for _, conn := range conns {
+		s := &muxSocket{
+			mux:     c,
+			conn:    conn,
+			w:       bufio.NewWriter(conn),
+			pending: make(map[uint64]*muxCall),
+		}
+		c.sockets = append(c.sockets, s)
+		go s.receive(bufio.NewReaderSize(conn, maxLineLength))
+	}
+	return c
+}
+
+func (c *MuxConn) maxItemSize() uint64 {
+	if c.MaxItemSize <= 0 {
+		return DefaultMaxItemSize
+	}
+	return uint64(c.MaxItemSize)
+}
+
+// socket picks the socket of key, or a socket in turn if key is empty. A failed socket
+// is replaced by the next working one.
+func (c *MuxConn) socket(key string) (*muxSocket, error) {
+	if len(c.sockets) == 0 {
+		return nil, errMuxClosed
+	}
+
+	var start uint32
+	if key == "" {
+		start = atomic.AddUint32(&c.next, 1)
+	} else {
+		start = keyHash(key)
+	}
+	var err error
+	// The index is computed in uint32, as int may be 32 bits wide.
+	n := uint32(len(c.sockets))
+	start %= n
+	for i := uint32(0); i < n; i++ {
+		s := c.sockets[(start+i)%n]
+		if err = s.failure(); err == nil {
+			return s, nil
+		}
+	}
+	return nil, err
+}
+
+// muxCall is a command waiting for its reply.
+type muxCall struct {
+	token     uint64
+	noreply   bool
+	wantStats bool
+	done      chan struct{}
+
+	// line is the first line of the reply, value the data block of a VA reply, and stats
+	// the statistics of a stats command. err is set when the socket fails.
+	line  []byte
+	value []byte
+	stats map[string]string
+	err   error
+}
+
+// muxSocket is a socket of a MuxConn.
+type muxSocket struct {
+	mux  *MuxConn
+	conn net.Conn
+
+	// wmu serializes the commands written to the socket, so that they are registered in
+	// the order they are sent.
+	wmu sync.Mutex
+	w   *bufio.Writer
+	buf []byte
+
+	mu      sync.Mutex
+	token   uint64
+	pending map[uint64]*muxCall
+	order   []*muxCall
+	err     error
+}
+
+// failure returns the error which failed the socket.
+func (s *muxSocket) failure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// send writes a command encoded by encode with a new token, followed by data if it isn't
+// nil. Unless noreply is true, it returns the call waiting for the reply. A noreply
+// command is followed by mn, and its call discards the replies up to MN.
+func (s *muxSocket) send(encode func(b []byte, token uint64) []byte, data []byte, noreply bool, wantStats bool) (*muxCall, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	s.token++
+	call := &muxCall{token: s.token, noreply: noreply, wantStats: wantStats, done: make(chan struct{})}
+	s.pending[call.token] = call
+	s.order = append(s.order, call)
+	s.mu.Unlock()
+
+	s.buf = encode(s.buf[:0], call.token)
+	_, err := s.w.Write(s.buf)
+	if err == nil && data != nil {
+		_, _ = s.w.Write(data)
+		_, err = s.w.Write(bytesCrlf)
+	}
+	if err == nil && noreply {
+		_, err = s.w.Write(commandMetaNoop)
+	}
+	if err == nil {
+		err = s.w.Flush()
+	}
+	if err != nil {
+		s.fail(err)
+		return nil, err
+	}
+	if noreply {
+		return nil, nil
+	}
+	return call, nil
+}
+
+// do sends a command on the socket of key and waits for its reply.
+func (c *MuxConn) do(key string, encode func(b []byte, token uint64) []byte, data []byte, noreply bool) (*muxCall, error) {
+	s, err := c.socket(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.do(encode, data, noreply)
+}
+
+// do sends a command and waits for its reply.
+func (s *muxSocket) do(encode func(b []byte, token uint64) []byte, data []byte, noreply bool) (*muxCall, error) {
+	call, err := s.send(encode, data, noreply, false)
+	if err != nil || call == nil {
+		return nil, err
+	}
+	<-call.done
+	return call, call.err
+}
+
+// take removes the call waiting for the reply line tagged with token, or the oldest call
+// if tagged is false. A noreply call is only removed by the MN reply. It returns nil if
+// there is no such call.
+func (s *muxSocket) take(line []byte, token uint64, tagged bool) *muxCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !tagged {
+		if len(s.order) == 0 {
+			return nil
+		}
+		token = s.order[0].token
+	}
+	call := s.pending[token]
+	if call != nil && call.noreply && !bytes.Equal(line, replyMetaNoop) {
+		return call
+	}
+	delete(s.pending, token)
+
+	// Drop the answered calls from the head of the order.
+	for len(s.order) > 0 && s.pending[s.order[0].token] == nil {
+		s.order = s.order[1:]
+	}
+	return call
+}
+
+// fail fails the socket and the calls waiting on it.
+func (s *muxSocket) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	for _, call := range s.pending {
+		call.err = err
+		close(call.done)
+	}
+	s.pending = nil
+	s.order = nil
+	_ = s.conn.Close()
+}
+
+// receive reads the replies and routes them to the waiting calls until the socket fails.
+func (s *muxSocket) receive(r *bufio.Reader) {
+	for {
+		line, err := readMuxLine(r)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		fields := bytes.Split(line, []byte(" "))
+		var value []byte
+		var valueErr error
+		if bytes.Equal(fields[0], replyMetaValue) {
+			// VA <size> <flags>*\r\n<data block>\r\n
+			size, ok := uint64(0), len(fields) > 1
+			if ok {
+				size, ok = parseUint(fields[1])
+			}
+			if !ok || size > math.MaxInt64-2 {
+				s.fail(memalpha.ProtocolError(fmt.Sprintf("malformed response: %#v", string(line))))
+				return
+			}
+			if size > s.mux.maxItemSize() {
+				// Skip the value, so that only the command it answers fails.
+				if _, err := io.CopyN(ioutil.Discard, r, int64(size)+2); err != nil {
+					s.fail(err)
+					return
+				}
+				valueErr = memalpha.ProtocolError(fmt.Sprintf("value of %d bytes exceeds max item size", size))
+			} else {
+				value = make([]byte, size+2)
+				if _, err := io.ReadFull(r, value); err != nil {
+					s.fail(err)
+					return
+				}
+				if !bytes.HasSuffix(value, bytesCrlf) {
+					s.fail(memalpha.ProtocolError("malformed response: corrupt get result end"))
+					return
+				}
+				value = value[:size]
+			}
+		}
+
+		token, tagged := opaqueToken(fields)
+		call := s.take(line, token, tagged)
+		if call == nil {
+			s.fail(memalpha.ProtocolError(fmt.Sprintf("unexpected reply: %s", string(line))))
+			return
+		}
+		if call.noreply {
+			// Nobody waits for the replies of a noreply command.
+			continue
+		}
+
+		call.line, call.value, call.err = line, value, valueErr
+		if call.wantStats {
+			if call.stats, err = readMuxStats(r, line); err != nil {
+				call.err = err
+				close(call.done)
+				s.fail(err)
+				return
+			}
+		}
+		close(call.done)
+	}
+}
+
+// readMuxLine reads a reply line into new memory.
+func readMuxLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, memalpha.ProtocolError("line too long")
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	return append([]byte(nil), line...), nil
+}
+
+// readMuxStats reads the STAT lines following line until END. An error reply is left to
+// the caller.
+func readMuxStats(r *bufio.Reader, line []byte) (map[string]string, error) {
+	m := make(map[string]string)
+	for {
+		if bytes.Equal(line, responseEnd) {
+			return m, nil
+		}
+		if !bytes.HasPrefix(line, responseStat) {
+			if len(m) == 0 {
+				return nil, nil
+			}
+			return nil, memalpha.ProtocolError("malformed stats response")
+		}
+
+		// STAT <name> <value>
+		stat := line[len(responseStat):]
+		i := bytes.IndexByte(stat, ' ')
+		if i <= 0 {
+			return nil, memalpha.ProtocolError("malformed stats response")
+		}
+		m[string(stat[:i])] = string(stat[i+1:])
+
+		var err error
+		if line, err = readMuxLine(r); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// opaqueToken returns the token of the O flag of a meta reply.
+func opaqueToken(fields [][]byte) (uint64, bool) {
+	switch {
+	case bytes.Equal(fields[0], replyMetaValue), bytes.Equal(fields[0], replyMetaHeader),
+		bytes.Equal(fields[0], replyMetaMiss), bytes.Equal(fields[0], replyMetaNotFound),
+		bytes.Equal(fields[0], replyMetaNotStore), bytes.Equal(fields[0], replyMetaExists):
+	default:
+		return 0, false
+	}
+	for _, field := range fields[1:] {
+		if len(field) > 1 && field[0] == 'O' {
+			return parseUint(field[1:])
+		}
+	}
+	return 0, false
+}
+
+// metaReplyError returns the error of a reply, or nil if it is HD.
+func metaReplyError(line []byte) error {
+	fields := bytes.SplitN(line, []byte(" "), 2)
+	switch {
+	case bytes.Equal(fields[0], replyMetaHeader):
+		return nil
+	case bytes.Equal(fields[0], replyMetaMiss):
+		return memalpha.ErrCacheMiss
+	case bytes.Equal(fields[0], replyMetaNotFound):
+		return memalpha.ErrNotFound
+	case bytes.Equal(fields[0], replyMetaNotStore):
+		return memalpha.ErrNotStored
+	case bytes.Equal(fields[0], replyMetaExists):
+		return memalpha.ErrCasConflict
+	case bytes.Equal(line, replyError):
+		return memalpha.ErrReplyError
+	case bytes.HasPrefix(line, replyClientErrorPrefix):
+		return memalpha.ClientError(line[len(replyClientErrorPrefix):])
+	case bytes.HasPrefix(line, replyServerErrorPrefix):
+		return memalpha.ServerError(line[len(replyServerErrorPrefix):])
+	}
+	return memalpha.ProtocolError(fmt.Sprintf("unknown reply type: %s", string(line)))
+}
+
+// appendMetaFlag appends a flag with a numeric token.
+func appendMetaFlag(b []byte, flag byte, token uint64) []byte {
+	b = append(b, ' ', flag)
+	return strconv.AppendUint(b, token, 10)
+}
+
+// appendMetaEnd terminates a meta command line with the quiet flag if noreply is true,
+// and the opaque token.
+func appendMetaEnd(b []byte, noreply bool, token uint64) []byte {
+	if noreply {
+		b = append(b, " q"...)
+	}
+	b = appendMetaFlag(b, 'O', token)
+	return append(b, bytesCrlf...)
+}
+
+// valueFlags returns the flags and the cas unique of a VA or HD reply.
+func valueFlags(line []byte) (response memalpha.Response, err error) {
+	fields := bytes.Split(line, []byte(" "))
+	for _, field := range fields[1:] {
+		if len(field) < 2 {
+			continue
+		}
+		ok := true
+		switch field[0] {
+		case 'f':
+			var flags uint64
+			flags, ok = parseUint(field[1:])
+			ok = ok && flags <= math.MaxUint32
+			response.Flags = uint32(flags)
+		case 'c':
+			response.CasID, ok = parseUint(field[1:])
+		}
+		if !ok {
+			return response, memalpha.ProtocolError(fmt.Sprintf("malformed response: %#v", string(line)))
+		}
+	}
+	return response, nil
+}
+
+// Close closes the sockets. Waiting commands fail.
+func (c *MuxConn) Close() error {
+	for _, s := range c.sockets {
+		s.fail(errMuxClosed)
+	}
+	return nil
+}
+
+//// Retrieval commands
+
+func encodeGet(key string, withCas bool) func(b []byte, token uint64) []byte {
+	return func(b []byte, token uint64) []byte {
+		// mg <key> v f [c] O<token>\r\n
+		b = append(b, "mg "...)
+		b = append(b, key...)
+		b = append(b, " v f"...)
+		if withCas {
+			b = append(b, " c"...)
+		}
+		return appendMetaEnd(b, false, token)
+	}
+}
+
+// receiveValue returns the value of the reply to a mg command.
+func receiveValue(call *muxCall) (*memalpha.Response, error) {
+	if !bytes.HasPrefix(call.line, replyMetaValue) {
+		return nil, metaReplyError(call.line)
+	}
+	response, err := valueFlags(call.line)
+	if err != nil {
+		return nil, err
+	}
+	response.Value = call.value
+	return &response, nil
+}
+
+// Get returns a value, flags and error.
+func (c *MuxConn) Get(key string) (value []byte, flags uint32, err error) {
+	if !legalKey(key) {
+		return nil, 0, memalpha.ErrMalformedKey
+	}
+
+	call, err := c.do(key, encodeGet(key, false), nil, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	response, err := receiveValue(call)
+	if err != nil {
+		return nil, 0, err
+	}
+	return response.Value, response.Flags, nil
+}
+
+// Gets is an alternative get command for using with CAS. The keys are pipelined.
+func (c *MuxConn) Gets(keys []string) (map[string]*memalpha.Response, error) {
+	if len(keys) == 0 {
+		return nil, memalpha.ErrMalformedKey
+	}
+	for _, key := range keys {
+		if !legalKey(key) {
+			return nil, memalpha.ErrMalformedKey
+		}
+	}
+
+	calls := make([]*muxCall, len(keys))
+	for i, key := range keys {
+		s, err := c.socket(key)
+		if err != nil {
+			return nil, err
+		}
+		if calls[i], err = s.send(encodeGet(key, true), nil, false, false); err != nil {
+			return nil, err
+		}
+	}
+
+	m := make(map[string]*memalpha.Response)
+	for i, call := range calls {
+		<-call.done
+		if call.err != nil {
+			return nil, call.err
+		}
+		response, err := receiveValue(call)
+		if err == memalpha.ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[keys[i]] = response
+	}
+	return m, nil
+}
+
+//// Storage commands
+
+// storageModes are the modes of ms for the storage commands.
+var storageModes = map[string]byte{"set": 'S', "add": 'E', "replace": 'R', "append": 'A', "prepend": 'P', "cas": 'S'}
+
+func (c *MuxConn) sendStorageCommand(command string, key string, value []byte, flags uint32, exptime int, casid uint64, noreply bool) error {
+	if !legalKey(key) {
+		return memalpha.ErrMalformedKey
+	}
+
+	call, err := c.do(key, func(b []byte, token uint64) []byte {
+		// ms <key> <datalen> [F<flags> T<exptime>] [C<cas unique>] M<mode> [q] O<token>\r\n
+		b = append(b, "ms "...)
+		b = append(b, key...)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, int64(len(value)), 10)
+		mode := storageModes[command]
+		if mode != 'A' && mode != 'P' {
+			b = appendMetaFlag(b, 'F', uint64(flags))
+			b = append(b, " T"...)
+			b = strconv.AppendInt(b, int64(exptime), 10)
+		}
+		if command == "cas" {
+			b = appendMetaFlag(b, 'C', casid)
+		}
+		b = append(b, " M"...)
+		b = append(b, mode)
+		return appendMetaEnd(b, noreply, token)
+	}, value, noreply)
+	if err != nil || call == nil {
+		return err
+	}
+	return metaReplyError(call.line)
+}
+
+// Set means "store this data".
+func (c *MuxConn) Set(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	return c.sendStorageCommand("set", key, value, flags, exptime, 0, noreply)
+}
+
+// Add means "store this data, but only if the server *doesn't* already hold data for this
+// key".
+func (c *MuxConn) Add(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	return c.sendStorageCommand("add", key, value, flags, exptime, 0, noreply)
+}
+
+// Replace means "store this data, but only if the server *does* already hold data for
+// this key".
+func (c *MuxConn) Replace(key string, value []byte, flags uint32, exptime int, noreply bool) error {
+	return c.sendStorageCommand("replace", key, value, flags, exptime, 0, noreply)
+}
+
+// Append means "add this data to an existing key after existing data". It ignores flags
+// and exptime settings.
+func (c *MuxConn) Append(key string, value []byte, noreply bool) error {
+	return c.sendStorageCommand("append", key, value, 0, 0, 0, noreply)
+}
+
+// Prepend means "add this data to an existing key before existing data". It ignores flags
+// and exptime settings.
+func (c *MuxConn) Prepend(key string, value []byte, noreply bool) error {
+	return c.sendStorageCommand("prepend", key, value, 0, 0, 0, noreply)
+}
+
+// CompareAndSwap is a check and set operation which means "store this data but only if no
+// one else has updated since I last fetched it."
+func (c *MuxConn) CompareAndSwap(key string, value []byte, casid uint64, flags uint32, exptime int, noreply bool) error {
+	return c.sendStorageCommand("cas", key, value, flags, exptime, casid, noreply)
+}
+
+//// Deletion
+
+// Delete deletes the item with the provided key
+func (c *MuxConn) Delete(key string, noreply bool) error {
+	if !legalKey(key) {
+		return memalpha.ErrMalformedKey
+	}
+
+	call, err := c.do(key, func(b []byte, token uint64) []byte {
+		// md <key> [q] O<token>\r\n
+		b = append(b, "md "...)
+		b = append(b, key...)
+		return appendMetaEnd(b, noreply, token)
+	}, nil, noreply)
+	if err != nil || call == nil {
+		return err
+	}
+	return metaReplyError(call.line)
+}
+
+//// Increment/Decrement
+
+// Increment key by value. value is the amount by which the client wants to increase
+// the item. It is a decimal representation of a 64-bit unsigned integer. The return
+// value is the new value. If noreply is true, the return value is always 0.
+// Note that Overflow in the "incr" command will wrap around the 64 bit mark.
+func (c *MuxConn) Increment(key string, value uint64, noreply bool) (uint64, error) {
+	return c.executeArithmeticCommand('I', key, value, noreply)
+}
+
+// Decrement key by value. value is the amount by which the client wants to decrease
+// the item. It is a decimal representation of a 64-bit unsigned integer. The return
+// value is the new value. If noreply is true, the return value is always 0.
+// Note that underflow in the "decr" command is caught: if a client tries to decrease
+// the value below 0, the new value will be 0.
+func (c *MuxConn) Decrement(key string, value uint64, noreply bool) (uint64, error) {
+	return c.executeArithmeticCommand('D', key, value, noreply)
+}
+
+func (c *MuxConn) executeArithmeticCommand(mode byte, key string, value uint64, noreply bool) (uint64, error) {
+	if !legalKey(key) {
+		return 0, memalpha.ErrMalformedKey
+	}
+
+	call, err := c.do(key, func(b []byte, token uint64) []byte {
+		// ma <key> D<delta> M<mode> v [q] O<token>\r\n
+		b = append(b, "ma "...)
+		b = append(b, key...)
+		b = appendMetaFlag(b, 'D', value)
+		b = append(b, " M"...)
+		b = append(b, mode)
+		b = append(b, " v"...)
+		return appendMetaEnd(b, noreply, token)
+	}, nil, noreply)
+	if err != nil || call == nil {
+		return 0, err
+	}
+	if !bytes.HasPrefix(call.line, replyMetaValue) {
+		return 0, metaReplyError(call.line)
+	}
+
+	newValue, ok := parseUint(call.value)
+	if !ok {
+		return 0, memalpha.ProtocolError(fmt.Sprintf("unknown reply type: %s", string(call.value)))
+	}
+	return newValue, nil
+}
+
+//// Touch
+
+// Touch is used to update the expiration time of an existing item without fetching it.
+func (c *MuxConn) Touch(key string, exptime int32, noreply bool) error {
+	if !legalKey(key) {
+		return memalpha.ErrMalformedKey
+	}
+
+	call, err := c.do(key, func(b []byte, token uint64) []byte {
+		// mg <key> T<exptime> [q] O<token>\r\n
+		b = append(b, "mg "...)
+		b = append(b, key...)
+		b = append(b, " T"...)
+		b = strconv.AppendInt(b, int64(exptime), 10)
+		return appendMetaEnd(b, noreply, token)
+	}, nil, noreply)
+	if err != nil || call == nil {
+		return err
+	}
+	if err = metaReplyError(call.line); err == memalpha.ErrCacheMiss {
+		return memalpha.ErrNotFound
+	}
+	return err
+}
+
+//// Statistics
+
+// Stats returns a map of stats. Depending on key, various internal data is sent by the
+// server. When the key is an empty string, the server will respond with a "default" set
+// of statistics information.
+func (c *MuxConn) Stats(statsKey string) (map[string]string, error) {
+	if !legalStatsKey(statsKey) {
+		return nil, memalpha.ErrMalformedKey
+	}
+
+	s, err := c.socket("")
+	if err != nil {
+		return nil, err
+	}
+	call, err := s.send(func(b []byte, token uint64) []byte {
+		// stats [<key>]\r\n
+		b = append(b, "stats "...)
+		b = append(b, statsKey...)
+		return append(b, bytesCrlf...)
+	}, nil, false, true)
+	if err != nil {
+		return nil, err
+	}
+
+	<-call.done
+	if call.err != nil {
+		return nil, call.err
+	}
+	if call.stats == nil {
+		return nil, metaReplyError(call.line)
+	}
+	return call.stats, nil
+}
+
+//// Other commands
+
+// FlushAll invalidates all existing items immediately (by default) or after the delay
+// specified. If delay is < 0, it ignores the delay.
+func (c *MuxConn) FlushAll(delay int, noreply bool) error {
+	encode := func(b []byte, token uint64) []byte {
+		// flush_all [delay] [noreply]\r\n
+		b = append(b, "flush_all"...)
+		if delay >= 0 {
+			b = append(b, ' ')
+			b = strconv.AppendInt(b, int64(delay), 10)
+		}
+		return appendNoreply(b, noreply)
+	}
+
+	// Flush on every socket, so that the commands sent after see it on any socket.
+	calls := make([]*muxCall, 0, len(c.sockets))
+	for _, s := range c.sockets {
+		call, err := s.send(encode, nil, noreply, false)
+		if err != nil {
+			return err
+		}
+		calls = append(calls, call)
+	}
+	if noreply {
+		return nil
+	}
+	for _, call := range calls {
+		<-call.done
+		if call.err != nil {
+			return call.err
+		}
+		if !bytes.Equal(call.line, replyOk) {
+			return metaReplyError(call.line)
+		}
+	}
+	return nil
+}
+
+// Version returns the version of memcached server
+func (c *MuxConn) Version() (string, error) {
+	call, err := c.do("", func(b []byte, token uint64) []byte {
+		// version\r\n
+		return append(b, commandVersion...)
+	}, nil, false)
+	if err != nil {
+		return "", err
+	}
+	if bytes.HasPrefix(call.line, bytesVersion) {
+		return string(call.line[len(bytesVersion):]), nil
+	}
+	return "", metaReplyError(call.line)
+}
+
+// Quit closes the connections to memcached server
+func (c *MuxConn) Quit() error {
+	for _, s := range c.sockets {
+		if _, err := s.send(func(b []byte, token uint64) []byte {
+			// quit\r\n
+			return append(b, commandQuit...)
+		}, nil, true, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
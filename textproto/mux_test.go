@@ -0,0 +1,178 @@
+package textproto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/conntest"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+)
+
+func startMux(t *testing.T) (*MuxConn, func()) {
+	memd := memdtest.NewServer(func(addr string) (memalpha.Conn, error) {
+		return DialMux(addr, 2)
+	})
+	if err := memd.Start(); err != nil {
+		t.Skipf("skipping test; couldn't start memcached: %s", err)
+	}
+	return memd.Conn.(*MuxConn), func() { _ = memd.Shutdown() }
+}
+
+func TestMuxConformance(t *testing.T) {
+	c, done := startMux(t)
+	defer done()
+
+	conntest.Run(t, func() (memalpha.Conn, error) {
+		return DialMux(c.Addr, 2)
+	})
+}
+
+func TestMuxConcurrent(t *testing.T) {
+	c, done := startMux(t)
+	defer done()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				key := fmt.Sprintf("key%d.%d", i, j)
+				value := bytes.Repeat([]byte{byte('a' + i)}, j)
+				assert.NoError(t, c.Set(key, value, uint32(j), 0, false))
+				got, flags, err := c.Get(key)
+				assert.NoError(t, err)
+				assert.Equal(t, value, got)
+				assert.EqualValues(t, j, flags)
+				if j%10 == 0 {
+					_, err = c.Stats("")
+					assert.NoError(t, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMuxReplies(t *testing.T) {
+	c, done := startMux(t)
+	defer done()
+
+	// The failure of a noreply command is dropped by its token.
+	assert.NoError(t, c.Set("foo", []byte("bar"), 0, 0, false))
+	assert.NoError(t, c.Add("foo", []byte("baz"), 0, 0, true))
+	value, _, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), value)
+
+	// So is an error without a token.
+	_, err = c.Increment("foo", 1, true)
+	assert.NoError(t, err)
+	value, _, err = c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), value)
+
+	// Replies without a token go to the oldest command.
+	large := make([]byte, DefaultMaxItemSize+1)
+	assert.Equal(t, memalpha.ServerError("object too large for cache"), c.Set("foo", large, 0, 0, false))
+	_, err = c.Increment("foo", 1, false)
+	assert.IsType(t, memalpha.ClientError(""), err)
+	version, err := c.Version()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, version)
+
+	_, err = c.Stats("\r\nflush_all")
+	assert.Equal(t, memalpha.ErrMalformedKey, err)
+
+	assert.NoError(t, c.Close())
+	_, _, err = c.Get("foo")
+	assert.Equal(t, errMuxClosed, err)
+}
+
+func TestMuxNoreplyErrors(t *testing.T) {
+	c, done := startMux(t)
+	defer done()
+
+	// The errors of noreply commands don't reach the commands of other goroutines on the
+	// same socket.
+	assert.NoError(t, c.Set("foo", []byte("bar"), 0, 0, false))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, err := c.Increment("foo", 1, true)
+				assert.NoError(t, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				value, _, err := c.Get("foo")
+				assert.NoError(t, err)
+				assert.Equal(t, []byte("bar"), value)
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, err := c.Version()
+	assert.NoError(t, err)
+}
+
+func TestMuxMaxItemSize(t *testing.T) {
+	c, done := startMux(t)
+	defer done()
+
+	// A value too large fails only its command.
+	mux, err := DialMux(c.Addr, 1)
+	assert.NoError(t, err)
+	defer func() { _ = mux.Close() }()
+	mux.MaxItemSize = 5
+	assert.NoError(t, mux.Set("foo", []byte("foobar"), 0, 0, false))
+	_, _, err = mux.Get("foo")
+	assert.IsType(t, memalpha.ProtocolError(""), err)
+	assert.NoError(t, mux.Set("foo", []byte("bar"), 0, 0, false))
+	value, _, err := mux.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), value)
+}
+
+func TestMuxSocketWraparound(t *testing.T) {
+	c := &MuxConn{next: math.MaxUint32 - 1}
+	for i := 0; i < 3; i++ {
+		c.sockets = append(c.sockets, &muxSocket{mux: c})
+	}
+	broken := errors.New("broken")
+	c.sockets[0].err = broken
+	c.sockets[1].err = broken
+
+	// The counter wraps from math.MaxUint32 to 0, and failed sockets are skipped in
+	// turn.
+	for i := 0; i < 3; i++ {
+		s, err := c.socket("")
+		assert.NoError(t, err)
+		assert.True(t, s == c.sockets[2])
+	}
+	c.sockets[2].err = broken
+	_, err := c.socket("")
+	assert.Equal(t, broken, err)
+}
+
+func TestMuxValueFlags(t *testing.T) {
+	response, err := valueFlags([]byte("VA 3 f4294967295 c42"))
+	assert.NoError(t, err)
+	assert.EqualValues(t, math.MaxUint32, response.Flags)
+	assert.EqualValues(t, 42, response.CasID)
+
+	_, err = valueFlags([]byte("VA 3 f4294967296"))
+	assert.IsType(t, memalpha.ProtocolError(""), err, "flags overflowing 32 bits")
+}
@@ -0,0 +1,172 @@
+package textproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/ttakezawa/memalpha"
+)
+
+var (
+	// ErrBusy means that a command was issued while a value returned by GetReader was
+	// still being read.
+	ErrBusy = errors.New("memcache: connection busy reading a value")
+
+	errReaderClosed = errors.New("memcache: read from a closed value")
+	errNegativeSize = errors.New("memcache: negative value size")
+)
+
+// setFromBufferSize is the largest value SetFrom reads into memory before sending the
+// command, so that a failing reader leaves the connection usable.
+const setFromBufferSize = 64 * 1024
+
+// valueReader reads a value from the connection. It holds the connection until the value
+// is fully read or closed.
+type valueReader struct {
+	c *TextConn
+	r io.LimitedReader
+
+	// done is set once the connection is released, and err is then returned by Read.
+	done bool
+	err  error
+}
+
+// GetReader is like Get, but returns a reader streaming the value from the connection
+// instead of buffering it. Until the reader is fully read or closed, other commands fail
+// with ErrBusy. Closing the reader early skips the rest of the value. As the value is
+// not buffered, it is not limited by MaxItemSize.
+func (c *TextConn) GetReader(key string) (value io.ReadCloser, size int, flags uint32, err error) {
+	if !legalKey(key) {
+		return nil, 0, 0, memalpha.ErrMalformedKey
+	}
+
+	c.sendRetrieveCommand("get", key)
+
+	var response memalpha.Response
+	_, n := c.receiveGetResponseHeader(&response, math.MaxInt)
+	if err = c.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	r := &valueReader{c: c, r: io.LimitedReader{R: c.rw, N: int64(n)}}
+	c.stream = r
+	if n == 0 {
+		if r.finish(); r.err != io.EOF {
+			return nil, 0, 0, r.err
+		}
+	}
+	return r, int(n), response.Flags, nil
+}
+
+func (r *valueReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, r.err
+	}
+	if r.c.stream != r {
+		// The connection was closed.
+		return 0, errReaderClosed
+	}
+
+	n, err := r.r.Read(p)
+	if r.r.N == 0 {
+		// Release the connection as soon as the value is read.
+		if r.finish(); r.err != io.EOF {
+			return n, r.err
+		}
+		return n, nil
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		r.fail(err)
+	}
+	return n, err
+}
+
+// Close skips the rest of the value and releases the connection.
+func (r *valueReader) Close() error {
+	if r.done || r.c.stream != r {
+		return nil
+	}
+
+	if _, err := r.c.rw.Discard(int(r.r.N)); err != nil {
+		r.fail(err)
+		return err
+	}
+	r.r.N = 0
+	if r.finish(); r.err != io.EOF {
+		return r.err
+	}
+	return nil
+}
+
+// finish receives the end of the response and releases the connection.
+func (r *valueReader) finish() {
+	c := r.c
+	c.stream = nil
+	r.done = true
+
+	if err := c.receiveGetResponseBodyEnd(); err != nil {
+		c.fail(err)
+	}
+	endLine := c.readLine()
+	if c.err == nil && !bytes.Equal(endLine, responseEnd) {
+		c.fail(memalpha.ProtocolError("malformed response: corrupt get result end"))
+	}
+	if r.err = c.Err(); r.err != nil {
+		return
+	}
+	r.err = io.EOF
+}
+
+// fail releases the connection, which is left in the middle of the value.
+func (r *valueReader) fail(err error) {
+	r.c.stream = nil
+	r.c.fail(err)
+	r.done = true
+	r.err = err
+}
+
+// SetFrom is like Set, but streams a value of size bytes from r instead of taking it in
+// memory. Values of up to 64KB are read before the command is sent, so an error of r
+// fails only this call. Larger values are streamed: if r doesn't provide size bytes, the
+// connection is left in the middle of the command, every later command fails and Broken
+// reports true.
+func (c *TextConn) SetFrom(key string, r io.Reader, size int, flags uint32, exptime int, noreply bool) error {
+	if !legalKey(key) {
+		return memalpha.ErrMalformedKey
+	}
+	if size < 0 {
+		return errNegativeSize
+	}
+	if size <= setFromBufferSize {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return err
+		}
+		return c.Set(key, value, flags, exptime, noreply)
+	}
+
+	c.writeStorageCommand("set", key, size, flags, exptime, 0, noreply)
+
+	// Send data block: <data block>\r\n
+	if c.err == nil {
+		if _, err := io.CopyN(c.rw, r, int64(size)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			c.fail(err)
+		}
+	}
+	c.write(bytesCrlf)
+	c.flush()
+
+	if !noreply {
+		c.receiveCheckReply()
+	}
+
+	return c.Err()
+}
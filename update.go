@@ -0,0 +1,102 @@
+package memalpha
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// ErrTooManyConflicts means Updater.Update gave up because the item kept being modified
+// by others.
+var ErrTooManyConflicts = errors.New("memcache: too many compare-and-swap conflicts")
+
+// Default settings of Updater.
+const (
+	DefaultUpdateAttempts   = 10
+	DefaultUpdateBackoff    = 5 * time.Millisecond
+	DefaultUpdateMaxBackoff = 500 * time.Millisecond
+)
+
+// UpdateFunc computes the new value of an item from its current value. found is false if
+// the item does not exist.
+type UpdateFunc func(old []byte, found bool) (new []byte, err error)
+
+// Updater performs read-modify-write cycles with "gets" and "cas", retrying on conflicts.
+type Updater struct {
+	conn Conn
+
+	// Exptime is the expiration time of stored items.
+	Exptime int
+
+	// MaxAttempts is the number of times Update calls its UpdateFunc before giving up.
+	MaxAttempts int
+
+	// Backoff is the wait before the first retry. It doubles on every further retry, up
+	// to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// NewUpdater creates an Updater over conn.
+func NewUpdater(conn Conn, exptime int) *Updater {
+	return &Updater{
+		conn:        conn,
+		Exptime:     exptime,
+		MaxAttempts: DefaultUpdateAttempts,
+		Backoff:     DefaultUpdateBackoff,
+		MaxBackoff:  DefaultUpdateMaxBackoff,
+	}
+}
+
+// Update atomically replaces the value of key with the result of f. An absent item is
+// created with "add" and an existing one is replaced with "cas", keeping its flags. If
+// another client modifies the item in between, f is called again with the new value. An
+// error from f aborts the update and is returned as is.
+func (u *Updater) Update(ctx context.Context, key string, f UpdateFunc) error {
+	backoff := u.Backoff
+	for attempt := 0; attempt < u.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			// Sleep for a random duration in [backoff/2, backoff) to spread competing
+			// clients.
+			wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+			if backoff *= 2; backoff > u.MaxBackoff {
+				backoff = u.MaxBackoff
+			}
+		}
+
+		m, err := u.conn.Gets([]string{key})
+		if err != nil {
+			return err
+		}
+		response, found := m[key]
+
+		var old []byte
+		if found {
+			old = response.Value
+		}
+		value, err := f(old, found)
+		if err != nil {
+			return err
+		}
+
+		if found {
+			err = u.conn.CompareAndSwap(key, value, response.CasID, response.Flags, u.Exptime, false)
+			if err == ErrCasConflict || err == ErrNotFound {
+				continue
+			}
+		} else {
+			err = u.conn.Add(key, value, 0, u.Exptime, false)
+			if err == ErrNotStored {
+				continue
+			}
+		}
+		return err
+	}
+	return ErrTooManyConflicts
+}
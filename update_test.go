@@ -0,0 +1,97 @@
+package memalpha_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ttakezawa/memalpha"
+	"github.com/ttakezawa/memalpha/internal/memdtest"
+)
+
+func appendX(old []byte, found bool) ([]byte, error) {
+	return append(old, 'x'), nil
+}
+
+func TestUpdate(t *testing.T) {
+	conn := memdtest.NewFakeConn()
+	u := memalpha.NewUpdater(conn, 0)
+	ctx := context.Background()
+
+	err := u.Update(ctx, "foo", appendX)
+	assert.NoError(t, err, "update creates a missing item")
+	err = conn.Set("bar", []byte("bar"), 42, 0, false)
+	assert.NoError(t, err)
+	err = u.Update(ctx, "bar", appendX)
+	assert.NoError(t, err)
+
+	value, _, err := conn.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("x"), value)
+	value, flags, err := conn.Get("bar")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("barx"), value)
+	assert.EqualValues(t, 42, flags, "flags are kept")
+
+	failure := errors.New("failure")
+	err = u.Update(ctx, "foo", func([]byte, bool) ([]byte, error) { return nil, failure })
+	assert.Equal(t, failure, err)
+}
+
+func TestUpdateConcurrently(t *testing.T) {
+	conn := memdtest.NewFakeConn()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u := memalpha.NewUpdater(conn, 0)
+			u.MaxAttempts = 1000
+			u.Backoff = time.Microsecond
+			u.MaxBackoff = time.Millisecond
+			err := u.Update(ctx, "count", func(old []byte, found bool) ([]byte, error) {
+				n, _ := strconv.Atoi(string(old))
+				return []byte(strconv.Itoa(n + 1)), nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	value, _, err := conn.Get("count")
+	assert.NoError(t, err)
+	assert.Equal(t, "10", string(value))
+}
+
+func TestUpdateTooManyConflicts(t *testing.T) {
+	conn := memdtest.NewFakeConn()
+	u := memalpha.NewUpdater(conn, 0)
+	u.MaxAttempts = 3
+	u.Backoff = time.Microsecond
+
+	calls := 0
+	err := u.Update(context.Background(), "foo", func(old []byte, found bool) ([]byte, error) {
+		calls++
+		// Someone else modifies the item every time.
+		if err := conn.Set("foo", []byte(strconv.Itoa(calls)), 0, 0, false); err != nil {
+			return nil, err
+		}
+		return []byte("mine"), nil
+	})
+	assert.Equal(t, memalpha.ErrTooManyConflicts, err)
+	assert.Equal(t, 3, calls)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	u.Backoff = time.Hour
+	err = u.Update(ctx, "foo", func(old []byte, found bool) ([]byte, error) {
+		return nil, conn.Set("foo", []byte("other"), 0, 0, false)
+	})
+	assert.Equal(t, context.Canceled, err)
+}